@@ -7,72 +7,133 @@ import (
 	"io"
 	"math/rand/v2"
 	"net/url"
+	"optable-pair-cli/pkg/metrics"
+	"path"
 	"strings"
 
-	"cloud.google.com/go/storage"
 	"github.com/rs/zerolog"
-	"gocloud.dev/blob/gcsblob"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
 )
 
 const CompletedFile = ".Completed"
 
+// The objects written from a source object record the URL and version of
+// the source in their metadata, its generation in GCS. Since objects are only
+// committed once fully written, an object with the metadata of its current
+// source is completed.
+const (
+	metadataSource           = "opair-source"
+	metadataSourceGeneration = "opair-source-generation"
+)
+
 type (
 	// ReadWriter contains the storage client and read writers for the source and destination buckets.
-	// Optionally, it can use a file reader instead of the source bucket.
+	// Optionally, it can use file readers instead of the source bucket. The objects are written under a
+	// staging prefix, and only moved to the destination bucket once promoted.
 	ReadWriter struct {
-		client            *storage.Client
-		FileReader        io.Reader
+		src               *blob.Bucket
+		dst               *blob.Bucket
+		abort             context.CancelFunc
+		FileReaders       []io.Reader
 		srcPrefixedBucket *PrefixedBucket
 		dstPrefixedBucket *PrefixedBucket
-		ReadWriters       []*ReadWriteCloser
+		stgPrefixedBucket *PrefixedBucket
+		// readersSource is recorded as the source of the objects written from
+		// the readers.
+		readersSource string
+		ReadWriters   []*ReadWriteCloser
 	}
 
 	Completer struct {
-		client            *storage.Client
+		bucket            *blob.Bucket
 		dstPrefixedBucket *PrefixedBucket
 	}
 
+	// PrefixedBucket is a folder of a bucket, e.g. gs://bucket/prefix.
 	PrefixedBucket struct {
+		Scheme string
 		Bucket string
 		Prefix string
 	}
 
 	// ReadWriteCloser contains the name of the object, its reader and a writer.
+	// The reader and the writer are nil when the object was already completed.
 	ReadWriteCloser struct {
-		name   string
-		Reader io.ReadCloser
-		Writer io.WriteCloser
+		name       string
+		srcURL     string
+		srcVersion string
+		dstURL     string
+		object     *stagedObject
+		size       int64
+		completed  bool
+		shards     *shardWriter
+		Reader     io.ReadCloser
+		Writer     io.WriteCloser
 	}
 
 	bucketOptions struct {
-		reader    io.Reader
-		sourceURL string
+		readers      []io.Reader
+		readersSrc   string
+		sourceURL    string
+		shardRows    int64
+		shardSize    int64
+		shardUploads int
+		compress     bool
 	}
 
 	// Option allows to configure the behavior of the Bucket.
 	Option func(*bucketOptions)
 )
 
-// GCSClientOptions is used to set insucure HTTP client for integration tests.
-var GCSClientOptions = []option.ClientOption{}
+// WithReaders allows to specify readers to be used for the bucket, instead of
+// the objects of the source bucket.
+func WithReaders(readers ...io.Reader) Option {
+	return func(o *bucketOptions) {
+		o.readers = readers
+	}
+}
+
+// WithReadersSource allows to specify the source of the data of the readers,
+// e.g. the path of the files read, recorded in the metadata of the objects
+// written. It defaults to the destination URL.
+func WithReadersSource(source string) Option {
+	return func(o *bucketOptions) {
+		o.readersSrc = source
+	}
+}
+
+// WithShardRows makes the bucket write the data of its readers to numbered
+// objects of at most the given number of rows each.
+func WithShardRows(rows int64) Option {
+	return func(o *bucketOptions) {
+		o.shardRows = rows
+	}
+}
 
-func gcsClientOptions(token string) []option.ClientOption {
-	return append(GCSClientOptions, option.WithTokenSource(
-		oauth2.StaticTokenSource(
-			&oauth2.Token{
-				AccessToken: token,
-			},
-		),
-	))
+// WithShardSize makes the bucket write the data of its readers to numbered
+// objects of about the given size in bytes each, ending on a full row. The size
+// is the one of the data before compression.
+func WithShardSize(size int64) Option {
+	return func(o *bucketOptions) {
+		o.shardSize = size
+	}
+}
+
+// WithShardUploads makes the bucket upload up to the given number of numbered
+// objects concurrently, each written through its own writer, see
+// ReadWriteCloser.Writers. The objects are uploaded one at a time by default.
+func WithShardUploads(uploads int) Option {
+	return func(o *bucketOptions) {
+		o.shardUploads = uploads
+	}
 }
 
-// WithReader allows to specify a reader to be used for the bucket.
-func WithReader(reader io.Reader) Option {
+// WithCompression makes the bucket write gzip-compressed objects, named with a
+// .gz suffix. The compressed objects read are decompressed regardless.
+func WithCompression(compress bool) Option {
 	return func(o *bucketOptions) {
-		o.reader = reader
+		o.compress = compress
 	}
 }
 
@@ -84,103 +145,142 @@ func WithSourceURL(srcURL string) Option {
 }
 
 // NewBucketCompleter creates a new BucketCompleter object which is used to signal that the transfer is complete.
-// Caller needs to call Close() on the returned BucketCompleter object to ensure
-func NewBucketCompleter(ctx context.Context, downscopedToken string, dstURL string) (*Completer, error) {
-	if downscopedToken == "" {
-		return nil, ErrTokenRequired
-	}
-
-	client, err := storage.NewClient(ctx, gcsClientOptions(downscopedToken)...)
+// The bucket is accessed through the client, which is closed by the caller.
+func NewBucketCompleter(ctx context.Context, client *Client, dstURL string) (*Completer, error) {
+	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
 	}
 
-	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
+	bucket, err := client.open(ctx, dstPrefixedBucket)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
+		return nil, err
 	}
 
 	return &Completer{
-		client:            client,
+		bucket:            bucket,
 		dstPrefixedBucket: dstPrefixedBucket,
 	}, nil
 }
 
 // Complete writes a .Completed file to the destination bucket to signal that the transfer is complete.
-// It then closes the client.
 func (b *Completer) Complete(ctx context.Context) error {
-	dstBucket := b.client.Bucket(b.dstPrefixedBucket.Bucket)
-	completedWriter := dstBucket.Object(fmt.Sprintf("%s/%s", b.dstPrefixedBucket.Prefix, CompletedFile)).NewWriter(ctx)
+	completedWriter, err := b.bucket.NewWriter(ctx, b.dstPrefixedBucket.Prefix+"/"+CompletedFile, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open completed file: %w", storageError(err))
+	}
+
 	if _, err := completedWriter.Write([]byte{}); err != nil {
-		return fmt.Errorf("failed to write completed file: %w", err)
+		return fmt.Errorf("failed to write completed file: %w", storageError(err))
 	}
 
 	if err := completedWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close completed file: %w", err)
+		return fmt.Errorf("failed to close completed file: %w", storageError(err))
 	}
 
-	return b.client.Close()
+	return nil
 }
 
 // Checks if the .Completed file exists in the destination bucket.
 func (b *Completer) HasCompleted(ctx context.Context) (bool, error) {
-	dstBucket := b.client.Bucket(b.dstPrefixedBucket.Bucket)
-	_, err := dstBucket.Object(fmt.Sprintf("%s/%s", b.dstPrefixedBucket.Prefix, CompletedFile)).Attrs(ctx)
-	if errors.Is(err, storage.ErrObjectNotExist) {
-		return false, nil
+	return hasCompleted(ctx, b.bucket, b.dstPrefixedBucket)
+}
+
+// HasCompleted checks if the .Completed file exists under the prefixed bucket.
+func HasCompleted(ctx context.Context, client *Client, pBucket *PrefixedBucket) (bool, error) {
+	bucket, err := client.open(ctx, pBucket)
+	if err != nil {
+		return false, err
 	}
-	return err == nil, err
+
+	return hasCompleted(ctx, bucket, pBucket)
 }
 
-// NewBucketReadWriter creates a new Bucket object and opens readers and writers for the specified source and destination URLs.
-// Caller needs to call Close() on the returned Bucket object to release resources.
-func NewBucketReadWriter(ctx context.Context, downscopedToken string, dstURL string, opts ...Option) (*ReadWriter, error) {
-	if downscopedToken == "" {
-		return nil, ErrTokenRequired
+func hasCompleted(ctx context.Context, bucket *blob.Bucket, pBucket *PrefixedBucket) (bool, error) {
+	_, err := bucket.Attributes(ctx, pBucket.Prefix+"/"+CompletedFile)
+	if isNotFound(err) {
+		return false, nil
 	}
+	return err == nil, storageError(err)
+}
 
+// ParseURL parses the URL of a folder, e.g. gs://bucket/prefix, into a prefixed bucket.
+func ParseURL(url string) (*PrefixedBucket, error) {
+	return bucketFromObjectURL(url)
+}
+
+// URL returns the URL of the folder.
+func (p *PrefixedBucket) URL() string {
+	return p.objectURL(p.Prefix)
+}
+
+// objectURL returns the URL of the object of the bucket with the given name.
+func (p *PrefixedBucket) objectURL(objectName string) string {
+	return fmt.Sprintf("%s://%s/%s", p.Scheme, p.Bucket, objectName)
+}
+
+// NewBucketReadWriter creates a new Bucket object and opens readers and writers for the specified source and destination URLs.
+// The buckets are accessed through the client. Caller needs to call Close() on the returned Bucket object to release
+// resources, and then on the client.
+func NewBucketReadWriter(ctx context.Context, client *Client, dstURL string, opts ...Option) (*ReadWriter, error) {
 	bucketOption := &bucketOptions{}
 	for _, opt := range opts {
 		opt(bucketOption)
 	}
 
-	client, err := storage.NewClient(ctx, gcsClientOptions(downscopedToken)...)
+	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
 	}
 
-	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
+	dst, err := client.open(ctx, dstPrefixedBucket)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
+		return nil, err
 	}
 
+	// the objects are written with their own context, cancelled by Abort to
+	// abort the uploads without committing the objects.
+	writeCtx, abort := context.WithCancel(ctx)
 	b := &ReadWriter{
-		client:            client,
+		dst:               dst,
+		abort:             abort,
 		dstPrefixedBucket: dstPrefixedBucket,
+		stgPrefixedBucket: stagingBucket(dstPrefixedBucket),
 	}
 
 	if src := bucketOption.sourceURL; src != "" {
 		srcPrefixedBucket, err := bucketFromObjectURL(src)
 		if err != nil {
+			b.Abort()
 			return nil, fmt.Errorf("failed to parse source URL: %w", err)
 		}
 
 		b.srcPrefixedBucket = srcPrefixedBucket
+		if b.src, err = client.open(ctx, srcPrefixedBucket); err != nil {
+			b.Abort()
+			return nil, err
+		}
 
-		if err := b.newObjectReadWriteCloser(ctx); err != nil {
+		if err := b.newObjectReadWriteCloser(ctx, writeCtx, bucketOption.compress); err != nil {
+			b.Abort()
 			return nil, fmt.Errorf("failed to create read writers: %w", err)
 		}
 
 		return b, nil
 	}
 
-	if reader := bucketOption.reader; reader != nil {
-		b.FileReader = reader
+	if readers := bucketOption.readers; len(readers) > 0 {
+		b.FileReaders = readers
+		b.readersSource = bucketOption.readersSrc
+		if b.readersSource == "" {
+			b.readersSource = dstURL
+		}
 
-		rw := b.newObjectWriteCloser(ctx)
+		rw := b.newObjectWriteCloser(writeCtx, bucketOption.shardRows, bucketOption.shardSize, bucketOption.shardUploads, bucketOption.compress)
 
 		b.ReadWriters = append(b.ReadWriters, rw)
 	} else {
+		b.Abort()
 		return nil, ErrInvalidBucketOptions
 	}
 
@@ -194,52 +294,84 @@ func bucketFromObjectURL(objectURL string) (*PrefixedBucket, error) {
 		return nil, err
 	}
 
-	if url.Scheme != gcsblob.Scheme {
-		return nil, fmt.Errorf("invalid object URL: %s", objectURL)
+	if !schemes[url.Scheme] || (url.Host == "" && url.Scheme != fileblob.Scheme) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidObjectURL, objectURL)
 	}
 
+	// the file:// URLs have no host, their path is relative to the root of
+	// the filesystem.
 	return &PrefixedBucket{
+		Scheme: url.Scheme,
 		Bucket: url.Host,
-		Prefix: strings.TrimLeft(url.Path, "/"),
+		Prefix: strings.Trim(url.Path, "/"),
 	}, nil
 }
 
 // newObjectReadWriteCloser lists the objects specified by the srcPrefixedBucket and opens a reader for each object,
 // except for the .Completed file.
-// It then opens a writer for each object under the same name specified by the destinationPrefix.
-func (b *ReadWriter) newObjectReadWriteCloser(ctx context.Context) error {
+// It then opens a writer for each object under the same name specified by the staging prefix, unless the
+// object was already completed. The objects are written gzip-compressed, with a .gz suffix, when compress is set.
+func (b *ReadWriter) newObjectReadWriteCloser(ctx, writeCtx context.Context, compress bool) error {
 	logger := zerolog.Ctx(ctx)
-	query := &storage.Query{Prefix: b.srcPrefixedBucket.Prefix + "/"}
 
-	srcBucket := b.client.Bucket(b.srcPrefixedBucket.Bucket)
-	dstBucket := b.client.Bucket(b.dstPrefixedBucket.Bucket)
-
-	it := srcBucket.Objects(ctx, query)
+	it := b.src.List(&blob.ListOptions{Prefix: b.srcPrefixedBucket.Prefix + "/"})
 	var rwc []*ReadWriteCloser
 
 	for {
-		obj, err := it.Next()
-		if errors.Is(err, iterator.Done) {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
 			break
 		} else if err != nil {
 			logger.Debug().Err(err).Msgf("failed to list objects from source bucket %s", b.srcPrefixedBucket.Prefix)
-			return err
+			return storageError(err)
 		}
 
-		if strings.HasSuffix(obj.Name, CompletedFile) || strings.HasSuffix(obj.Name, "/") || obj.Size == 0 {
+		if !isDataObject(obj) {
 			continue
 		}
 
-		reader, err := srcBucket.Object(obj.Name).NewReader(ctx)
+		rw := b.sourceReadWriteCloser(obj, compress)
+		srcURL, dstURL := rw.srcURL, rw.dstURL
+
+		// objects completed by a previous run are not written again.
+		completed, err := rw.isCompleted(ctx)
 		if err != nil {
 			return err
 		}
+		if completed {
+			logger.Debug().Msgf("object %s already written from %s", dstURL, srcURL)
+			rw.completed = true
+			rwc = append(rwc, rw)
+			continue
+		}
+
+		stored, err := b.src.NewReader(ctx, obj.Key, pinVersion(obj))
+		if err != nil {
+			return storageError(err)
+		}
+
+		reader, compressed, err := decompress(traceReader(ctx, srcURL, metrics.StorageReader(stored)))
+		if err != nil {
+			_ = stored.Close()
+			return fmt.Errorf("failed to read %s: %w", srcURL, err)
+		}
+		if compressed {
+			// the size of the data once decompressed is unknown.
+			rw.size = 0
+		}
 
-		rwc = append(rwc, &ReadWriteCloser{
-			name:   blobFromObjectName(obj.Name),
-			Reader: reader,
-			Writer: dstBucket.Object(objectPathWithPrefix(obj.Name, b.dstPrefixedBucket.Prefix)).NewWriter(ctx),
+		writer, err := rw.object.newWriter(writeCtx, map[string]string{
+			metadataSource:           srcURL,
+			metadataSourceGeneration: rw.srcVersion,
 		})
+		if err != nil {
+			_ = reader.Close()
+			return err
+		}
+
+		rw.Reader = reader
+		rw.Writer = traceWriter(ctx, b.stgPrefixedBucket.objectURL(rw.object.staged), writer)
+		rwc = append(rwc, rw)
 	}
 
 	b.ReadWriters = rwc
@@ -247,42 +379,224 @@ func (b *ReadWriter) newObjectReadWriteCloser(ctx context.Context) error {
 	return nil
 }
 
-// newObjectWriteCloser creates a new writer for the destination bucket.
-func (b *ReadWriter) newObjectWriteCloser(ctx context.Context) *ReadWriteCloser {
-	dstBucket := b.client.Bucket(b.dstPrefixedBucket.Bucket)
-	writer := dstBucket.Object(fmt.Sprintf("%s/data_%s.csv", b.dstPrefixedBucket.Prefix, shortHex())).NewWriter(ctx)
+// sourceReadWriteCloser returns the ReadWriteCloser of the source object, named
+// after it under the staging and destination prefixes, with no reader nor writer.
+func (b *ReadWriter) sourceReadWriteCloser(obj *blob.ListObject, compress bool) *ReadWriteCloser {
+	var (
+		name    = compressedName(obj.Key, compress)
+		dstName = objectPathWithPrefix(name, b.srcPrefixedBucket.Prefix, b.dstPrefixedBucket.Prefix)
+		stgName = objectPathWithPrefix(name, b.srcPrefixedBucket.Prefix, b.stgPrefixedBucket.Prefix)
+		dstURL  = b.dstPrefixedBucket.objectURL(dstName)
+	)
+
+	return &ReadWriteCloser{
+		name:       path.Base(dstName),
+		srcURL:     b.srcPrefixedBucket.objectURL(obj.Key),
+		srcVersion: objectVersion(obj),
+		dstURL:     dstURL,
+		object: &stagedObject{
+			bucket:   b.dst,
+			staged:   stgName,
+			final:    dstName,
+			url:      dstURL,
+			compress: compress,
+		},
+		size: obj.Size,
+	}
+}
+
+// newObjectWriteCloser creates a new writer for the destination bucket, which
+// writes to numbered objects when shardRows or shardSize are set, up to
+// shardUploads of them concurrently, gzip-compressed when compress is set.
+func (b *ReadWriter) newObjectWriteCloser(ctx context.Context, shardRows, shardSize int64, shardUploads int, compress bool) *ReadWriteCloser {
+	prefix := "data_" + shortHex()
+	name := func(int) string { return compressedName(prefix+".csv", compress) }
+	if shardRows > 0 || shardSize > 0 {
+		name = func(shard int) string { return compressedName(fmt.Sprintf("%s_%05d.csv", prefix, shard), compress) }
+	}
+
+	metadata := map[string]string{metadataSource: b.readersSource}
+	shards := newShardWriter(ctx, b.dst, b.stgPrefixedBucket, b.dstPrefixedBucket, name, metadata, shardRows, shardSize, compress, shardUploads)
 	return &ReadWriteCloser{
 		name:   CompletedFile,
-		Writer: writer,
+		dstURL: b.dstPrefixedBucket.objectURL(b.dstPrefixedBucket.Prefix + "/" + name(0)),
+		shards: shards,
+		Writer: shards,
 	}
 }
 
-// Close closes the client and all read writers.
-func (b *ReadWriter) Close() error {
-	for _, rw := range b.ReadWriters {
-		if rw.Reader != nil {
-			if err := rw.Reader.Close(); err != nil {
-				return err
-			}
+// SourceURL returns the URL of the object read by the ReadWriteCloser, if any.
+func (rw *ReadWriteCloser) SourceURL() string {
+	return rw.srcURL
+}
+
+// DestinationURL returns the URL of the object written by the ReadWriteCloser,
+// or of its first object when writing to numbered objects.
+func (rw *ReadWriteCloser) DestinationURL() string {
+	return rw.dstURL
+}
+
+// Writers returns the writers of the objects written by the ReadWriteCloser,
+// which are written concurrently, each to its own numbered objects. Writer
+// writes to the first one, the only one unless uploading numbered objects
+// concurrently.
+func (rw *ReadWriteCloser) Writers() []io.Writer {
+	if rw.shards != nil {
+		return rw.shards.writers()
+	}
+
+	return []io.Writer{rw.Writer}
+}
+
+// DestinationURLs returns the URLs of all the objects written by the ReadWriteCloser.
+func (rw *ReadWriteCloser) DestinationURLs() []string {
+	if rw.shards != nil {
+		return rw.shards.urls
+	}
+
+	return []string{rw.dstURL}
+}
+
+// Size returns the size in bytes of the object read by the ReadWriteCloser, if
+// any, or 0 when unknown as the object is compressed.
+func (rw *ReadWriteCloser) Size() int64 {
+	return rw.size
+}
+
+// Completed returns whether the object was already written, by a previous run
+// or since committed.
+func (rw *ReadWriteCloser) Completed() bool {
+	return rw.completed
+}
+
+// Commit closes the reader and the writer, committing the written object.
+func (rw *ReadWriteCloser) Commit() error {
+	if rw.completed {
+		return nil
+	}
+
+	if rw.Reader != nil {
+		if err := rw.Reader.Close(); err != nil {
+			return err
 		}
+	}
+
+	if err := rw.Writer.Close(); err != nil {
+		return storageError(err)
+	}
+
+	rw.completed = true
+	return nil
+}
+
+// NewDestinationReader opens a reader of the written object, staged or promoted,
+// decompressed when compressed. The data of the object as stored is also
+// written to stored while read, when not nil.
+func (rw *ReadWriteCloser) NewDestinationReader(ctx context.Context, stored io.Writer) (io.ReadCloser, error) {
+	key := rw.object.staged
+	if rw.object.promoted {
+		key = rw.object.final
+	}
+
+	obj, err := rw.object.bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return nil, storageError(err)
+	}
 
-		if err := rw.Writer.Close(); err != nil {
+	var r io.ReadCloser = traceReader(ctx, rw.dstURL, metrics.StorageReader(obj))
+	if stored != nil {
+		r = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r, stored), r}
+	}
+
+	r, _, err = decompress(r)
+	if err != nil {
+		_ = obj.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", rw.dstURL, err)
+	}
+
+	return r, nil
+}
+
+// isCompleted checks whether the object was written from the current
+// version of the source object, either staged or already promoted.
+func (rw *ReadWriteCloser) isCompleted(ctx context.Context) (bool, error) {
+	for _, key := range []string{rw.object.staged, rw.object.final} {
+		attrs, err := rw.object.bucket.Attributes(ctx, key)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return false, storageError(err)
+		}
+
+		if attrs.Metadata[metadataSource] == rw.srcURL &&
+			attrs.Metadata[metadataSourceGeneration] == rw.srcVersion {
+			rw.object.promoted = key == rw.object.final
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isOwnSource returns whether the objects written from the source, as recorded
+// in their metadata, are written by the ReadWriter: the objects of the source
+// prefix, or the data of the readers.
+func (b *ReadWriter) isOwnSource(source string) bool {
+	if b.srcPrefixedBucket != nil {
+		return strings.HasPrefix(source, b.srcPrefixedBucket.objectURL(b.srcPrefixedBucket.Prefix+"/"))
+	}
+
+	return source == b.readersSource
+}
+
+// Close commits the objects not committed yet under the staging prefix.
+// Promote moves them to the destination prefix beforehand.
+func (b *ReadWriter) Close() error {
+	for _, rw := range b.ReadWriters {
+		if err := rw.Commit(); err != nil {
 			return err
 		}
 	}
 
-	return b.client.Close()
+	b.abort()
+	return nil
 }
 
-func objectPathWithPrefix(objectName string, prefix string) string {
-	return fmt.Sprintf("%s/%s", prefix, blobFromObjectName(objectName))
+// Abort aborts the uploads in progress without committing the objects, and
+// releases the resources. It is called instead of Close when the transfer
+// fails or is interrupted, so no partial object is ever committed. The
+// objects read from a source bucket and already committed are kept under the
+// staging prefix, to resume from; the numbered objects are deleted.
+func (b *ReadWriter) Abort() {
+	b.abort()
+
+	for _, rw := range b.ReadWriters {
+		if rw.completed {
+			continue
+		}
+
+		if rw.shards != nil {
+			rw.shards.abort()
+			continue
+		}
+
+		if rw.Reader != nil {
+			_ = rw.Reader.Close()
+		}
+
+		// closing a writer once its context is cancelled does not commit the object.
+		_ = rw.Writer.Close()
+	}
 }
 
-func blobFromObjectName(objectName string) string {
-	split := strings.Split(objectName, "/")
-	obj := split[len(split)-1]
-	split = strings.Split(obj, ".")
-	return fmt.Sprintf("%s-%s.%s", split[0], shortHex(), split[1])
+// objectPathWithPrefix returns the name of the object under dstPrefix for the
+// object under srcPrefix, keeping its path relative to srcPrefix so that the
+// name is the same on every run.
+func objectPathWithPrefix(objectName, srcPrefix, dstPrefix string) string {
+	return fmt.Sprintf("%s/%s", dstPrefix, strings.TrimPrefix(objectName, srcPrefix+"/"))
 }
 
 func shortHex() string {
@@ -0,0 +1,261 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/gcp"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// GCSClientOptions is used to set insecure HTTP client for integration tests.
+// The HTTP client and endpoint of a Client take precedence over them.
+var GCSClientOptions = []option.ClientOption{}
+
+type (
+	// Client opens the buckets of the PAIR data paths. Each bucket is opened
+	// once and shared by the Completer, ReadWriter and Readers created with
+	// the client, until Close is called.
+	Client struct {
+		endpoint    *url.URL
+		httpClient  *http.Client
+		tokenSource oauth2.TokenSource
+		retryPolicy *RetryPolicy
+
+		mu      sync.Mutex // guards buckets
+		buckets map[string]*blob.Bucket
+	}
+
+	// RetryPolicy configures how the requests to GCS are retried on transient errors.
+	RetryPolicy struct {
+		// MaxAttempts is the maximum number of attempts of a request, 0 for no limit.
+		MaxAttempts int
+		// Initial is the delay before the first retry.
+		Initial time.Duration
+		// Max caps the delay between two attempts.
+		Max time.Duration
+		// Multiplier is the factor by which the delay grows after each attempt.
+		Multiplier float64
+	}
+
+	// ClientOption allows to configure the behavior of the Client.
+	ClientOption func(*Client)
+)
+
+// NewClient creates a client accessing GCS with the down scoped token of the
+// clean room, unless a token source is provided. S3 and Azure Blob Storage
+// buckets are accessed with the credentials found in the environment, and
+// file:// URLs are paths of the local filesystem. Caller needs to call Close()
+// on the returned client to release resources.
+func NewClient(downscopedToken string, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		buckets: make(map[string]*blob.Bucket),
+	}
+
+	if downscopedToken != "" {
+		c.tokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: downscopedToken})
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.tokenSource == nil {
+		return nil, ErrTokenRequired
+	}
+
+	if c.endpoint != nil && (c.endpoint.Scheme == "" || c.endpoint.Host == "") {
+		return nil, fmt.Errorf("%w: invalid endpoint %s", ErrInvalidBucketOptions, c.endpoint)
+	}
+
+	return c, nil
+}
+
+// WithEndpoint sends the requests to GCS to the endpoint, e.g. the URL of a
+// proxy or an emulator. Every request is rewritten to target the endpoint, so
+// it takes precedence over the STORAGE_EMULATOR_HOST environment variable.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint, _ = url.Parse(endpoint)
+		if c.endpoint == nil {
+			c.endpoint = &url.URL{}
+		}
+	}
+}
+
+// WithHTTPClient sets the HTTP client the requests to GCS are sent with,
+// authenticated by the client.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithTokenSource sets the source of the tokens GCS is accessed with, instead
+// of the down scoped token.
+func WithTokenSource(source oauth2.TokenSource) ClientOption {
+	return func(c *Client) {
+		c.tokenSource = source
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry the requests to GCS, instead
+// of the one of the GCS client library.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retryPolicy = &policy
+	}
+}
+
+// open returns the bucket of the prefixed bucket, opening it the first time.
+func (c *Client) open(ctx context.Context, pBucket *PrefixedBucket) (*blob.Bucket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := pBucket.Scheme + "://" + pBucket.Bucket
+	if b, ok := c.buckets[key]; ok {
+		return b, nil
+	}
+
+	var (
+		b   *blob.Bucket
+		err error
+	)
+	switch pBucket.Scheme {
+	case gcsblob.Scheme:
+		b, err = c.openGCS(ctx, pBucket.Bucket)
+
+	case fileblob.Scheme:
+		// the temporary files are written next to the objects, so that they
+		// are renamed on the same filesystem.
+		b, err = fileblob.OpenBucket("/", &fileblob.Options{NoTempDir: true})
+
+	default:
+		b, err = blob.OpenBucket(ctx, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket %s: %w", key, err)
+	}
+
+	c.buckets[key] = b
+	return b, nil
+}
+
+// openGCS opens the GCS bucket with the HTTP client, endpoint, token source
+// and retry policy of the client. The storage client of the bucket is created
+// by opair rather than by gcsblob, which expects STORAGE_EMULATOR_HOST without
+// a scheme and then ignores the HTTP client, while the storage library accepts
+// it with or without a scheme.
+func (c *Client) openGCS(ctx context.Context, name string) (*blob.Bucket, error) {
+	client, err := storage.NewClient(ctx, slices.Concat(GCSClientOptions, c.gcsClientOptions())...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	if c.retryPolicy != nil {
+		client.SetRetry(c.retryPolicy.options()...)
+	}
+
+	b, err := gcsblob.OpenBucket(ctx, &gcp.HTTPClient{}, name, nil)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	var bucketClient *storage.Client
+	if !b.As(&bucketClient) {
+		_ = client.Close()
+		_ = b.Close()
+		return nil, fmt.Errorf("failed to access the storage client of bucket %s", name)
+	}
+	*bucketClient = *client
+
+	return b, nil
+}
+
+// gcsClientOptions returns the options of the GCS clients, which take
+// precedence over GCSClientOptions. The requests are sent through the HTTP
+// client of the client, to its endpoint, when either is set. Otherwise, they
+// are authenticated with the token source, but for the emulator set by
+// STORAGE_EMULATOR_HOST, which does not authenticate them.
+func (c *Client) gcsClientOptions() []option.ClientOption {
+	if c.httpClient == nil && c.endpoint == nil {
+		if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+			return nil
+		}
+
+		return []option.ClientOption{option.WithTokenSource(c.tokenSource)}
+	}
+
+	httpClient := http.Client{}
+	if c.httpClient != nil {
+		httpClient = *c.httpClient
+	}
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if c.endpoint != nil {
+		transport = &endpointTransport{endpoint: c.endpoint, base: transport}
+	}
+	httpClient.Transport = &oauth2.Transport{Source: c.tokenSource, Base: transport}
+
+	return []option.ClientOption{option.WithHTTPClient(&httpClient)}
+}
+
+func (p *RetryPolicy) options() []storage.RetryOption {
+	opts := []storage.RetryOption{
+		storage.WithBackoff(gax.Backoff{
+			Initial:    p.Initial,
+			Max:        p.Max,
+			Multiplier: p.Multiplier,
+		}),
+	}
+	if p.MaxAttempts > 0 {
+		opts = append(opts, storage.WithMaxAttempts(p.MaxAttempts))
+	}
+
+	return opts
+}
+
+// Close closes the buckets opened by the client.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for key, b := range c.buckets {
+		errs = append(errs, b.Close())
+		delete(c.buckets, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+// endpointTransport sends the requests to the endpoint instead of the host they target.
+type endpointTransport struct {
+	endpoint *url.URL
+	base     http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.endpoint.Scheme
+	req.URL.Host = t.endpoint.Host
+	req.Host = t.endpoint.Host
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,60 @@
+package bucket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The objects can be stored gzip-compressed to reduce the egress of large
+// clean rooms. They are written with a .gz suffix, and detected on read by the
+// magic number of gzip, so that the objects uploaded with Content-Encoding:
+// gzip are decompressed as well when the storage serves them as stored.
+const gzipSuffix = ".gz"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compressedName returns the name of the object holding the data of the
+// object with the given name, with the .gz suffix when compressed.
+func compressedName(name string, compress bool) string {
+	name = strings.TrimSuffix(name, gzipSuffix)
+	if compress {
+		return name + gzipSuffix
+	}
+
+	return name
+}
+
+type decompressingReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *decompressingReader) Close() error {
+	return r.closer.Close()
+}
+
+// decompress returns a reader of the data of the object read by r, which is
+// decompressed when gzip-compressed, and whether it is.
+func decompress(r io.ReadCloser) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, storageError(err)
+	}
+
+	if !bytes.Equal(magic, gzipMagic) {
+		return &decompressingReader{Reader: br, closer: r}, false, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read gzip header: %w", err)
+	}
+
+	return &decompressingReader{Reader: gz, closer: r}, true, nil
+}
@@ -0,0 +1,78 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+// Object describes a data object stored under a prefixed bucket.
+type Object struct {
+	URL  string
+	Size int64
+	// CRC32C is the hex CRC32C checksum of the object, empty when the storage
+	// does not provide one.
+	CRC32C string
+	// Compressed is set when the object is gzip-compressed, in which case Size
+	// and CRC32C describe the compressed data. Only known once the object is read.
+	Compressed bool
+	// listed is the object as listed, when read through Readers.
+	listed *blob.ListObject
+}
+
+// isDataObject returns whether the object holds PAIR data, as opposed to the
+// markers written alongside it, to the staged objects and to folders.
+func isDataObject(obj *blob.ListObject) bool {
+	return !isMarker(obj.Key) && !isStaged(obj.Key) && !obj.IsDir && !strings.HasSuffix(obj.Key, "/") && obj.Size > 0
+}
+
+// isStaged returns whether the object is staged, under the staging folder of a prefix.
+func isStaged(name string) bool {
+	return strings.Contains("/"+name, "/"+stagingDir+"/")
+}
+
+// isMarker returns whether the object is the .Completed file or the manifest.
+func isMarker(name string) bool {
+	return strings.HasSuffix(name, CompletedFile) || strings.HasSuffix(name, ManifestFile)
+}
+
+// ListObjects lists the data objects stored under the specified URL, except for the .Completed file and the manifest.
+func ListObjects(ctx context.Context, client *Client, prefixURL string) ([]Object, error) {
+	prefixedBucket, err := bucketFromObjectURL(prefixURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse object URL: %w", err)
+	}
+
+	bucket, err := client.open(ctx, prefixedBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	it := bucket.List(&blob.ListOptions{Prefix: prefixedBucket.Prefix + "/"})
+
+	var objects []Object
+	for {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list objects from bucket %s: %w", prefixedBucket.URL(), storageError(err))
+		}
+
+		if !isDataObject(obj) {
+			continue
+		}
+
+		objects = append(objects, Object{
+			URL:    prefixedBucket.objectURL(obj.Key),
+			Size:   obj.Size,
+			CRC32C: objectCRC32C(obj),
+		})
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,170 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"gocloud.dev/blob"
+)
+
+// ManifestFile is the name of the manifest written alongside the .Completed
+// file, describing the objects uploaded under the prefix.
+const ManifestFile = ".Manifest.json"
+
+// ErrNoManifest is returned when no manifest was written under a prefix.
+var ErrNoManifest = errors.New("no manifest")
+
+type (
+	// Manifest describes the objects uploaded by a step under a prefix.
+	Manifest struct {
+		URL            string           `json:"url"`
+		Step           string           `json:"step"`
+		OpairVersion   string           `json:"opair_version"`
+		KeyFingerprint string           `json:"key_fingerprint"`
+		CreatedAt      time.Time        `json:"created_at"`
+		Objects        []ManifestObject `json:"objects"`
+	}
+
+	// ManifestObject describes an object listed in a manifest.
+	ManifestObject struct {
+		URL    string `json:"url"`
+		Size   int64  `json:"size"`
+		CRC32C string `json:"crc32c"`
+		MD5    string `json:"md5"`
+		Rows   int64  `json:"rows"`
+	}
+)
+
+// Manifest returns the manifest of the objects promoted to the destination
+// prefix. It must be called once the objects are promoted.
+func (b *ReadWriter) Manifest(ctx context.Context) (*Manifest, error) {
+	manifest := &Manifest{
+		URL: b.dstPrefixedBucket.URL(),
+	}
+
+	for _, rw := range b.ReadWriters {
+		for _, o := range rw.objects() {
+			attrs, err := o.bucket.Attributes(ctx, o.final)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the attributes of %s: %w", o.url, storageError(err))
+			}
+
+			rows, err := o.rows(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			object := ManifestObject{
+				URL:  o.url,
+				Size: attrs.Size,
+				MD5:  hex.EncodeToString(attrs.MD5),
+				Rows: rows,
+			}
+
+			var gcsAttrs storage.ObjectAttrs
+			if attrs.As(&gcsAttrs) {
+				object.CRC32C = fmt.Sprintf("%08x", gcsAttrs.CRC32C)
+			} else if o.writer != nil {
+				object.CRC32C = fmt.Sprintf("%08x", o.writer.checksum.crc.Sum32())
+			}
+
+			manifest.Objects = append(manifest.Objects, object)
+		}
+	}
+
+	return manifest, nil
+}
+
+// rows returns the number of rows of the promoted object: the rows written by
+// this run, or the rows read from the object when written by a previous run.
+func (o *stagedObject) rows(ctx context.Context) (int64, error) {
+	if o.writer != nil {
+		return o.writer.rows, nil
+	}
+
+	stored, err := o.bucket.NewReader(ctx, o.final, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", o.url, storageError(err))
+	}
+
+	r, _, err := decompress(stored)
+	if err != nil {
+		_ = stored.Close()
+		return 0, fmt.Errorf("failed to read %s: %w", o.url, err)
+	}
+	defer r.Close()
+
+	var (
+		rows int64
+		buf  = make([]byte, 32*1024)
+	)
+	for {
+		n, err := r.Read(buf)
+		rows += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", o.url, storageError(err))
+		}
+	}
+}
+
+// WriteManifest writes the manifest to the destination bucket. It must be
+// called before Complete.
+func (b *Completer) WriteManifest(ctx context.Context, manifest *Manifest) error {
+	manifestWriter, err := b.bucket.NewWriter(ctx, b.dstPrefixedBucket.Prefix+"/"+ManifestFile, &blob.WriterOptions{
+		ContentType: "application/json",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", storageError(err))
+	}
+
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", storageError(err))
+	}
+
+	if err := manifestWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", storageError(err))
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest written under the specified URL. It returns
+// ErrNoManifest if there is none.
+func ReadManifest(ctx context.Context, client *Client, prefixURL string) (*Manifest, error) {
+	prefixedBucket, err := bucketFromObjectURL(prefixURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse object URL: %w", err)
+	}
+
+	bucket, err := client.open(ctx, prefixedBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	name := prefixedBucket.Prefix + "/" + ManifestFile
+	reader, err := bucket.NewReader(ctx, name, nil)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w under %s", ErrNoManifest, prefixURL)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", prefixedBucket.objectURL(name), storageError(err))
+	}
+	defer reader.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", prefixedBucket.objectURL(name), err)
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,106 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"gocloud.dev/blob"
+)
+
+// PlannedObject describes the object a ReadWriter would write from an object
+// of its source bucket.
+type PlannedObject struct {
+	Source Object
+	// StagingURL is the URL the object is written to before being promoted
+	// to DestinationURL.
+	StagingURL     string
+	DestinationURL string
+	// Completed is set when the object was already written from the current
+	// version of the source object by a previous run, and would be skipped.
+	Completed bool
+	// Promoted is set when the completed object is already promoted to
+	// DestinationURL, it is staged otherwise.
+	Promoted bool
+}
+
+// PlanReadWrites lists the objects a ReadWriter would write to dstURL from the
+// objects stored under srcURL, without reading nor writing any. The objects are
+// named with a .gz suffix when compress is set.
+func PlanReadWrites(ctx context.Context, client *Client, srcURL, dstURL string, compress bool) ([]PlannedObject, error) {
+	srcPrefixedBucket, err := bucketFromObjectURL(srcURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source URL: %w", err)
+	}
+
+	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
+	}
+
+	src, err := client.open(ctx, srcPrefixedBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := client.open(ctx, dstPrefixedBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &ReadWriter{
+		src:               src,
+		dst:               dst,
+		srcPrefixedBucket: srcPrefixedBucket,
+		dstPrefixedBucket: dstPrefixedBucket,
+		stgPrefixedBucket: stagingBucket(dstPrefixedBucket),
+	}
+
+	it := src.List(&blob.ListOptions{Prefix: srcPrefixedBucket.Prefix + "/"})
+
+	var objects []PlannedObject
+	for {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list objects from bucket %s: %w", srcPrefixedBucket.URL(), storageError(err))
+		}
+
+		if !isDataObject(obj) {
+			continue
+		}
+
+		rw := b.sourceReadWriteCloser(obj, compress)
+		completed, err := rw.isCompleted(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, PlannedObject{
+			Source: Object{
+				URL:    rw.srcURL,
+				Size:   obj.Size,
+				CRC32C: objectCRC32C(obj),
+			},
+			StagingURL:     b.stgPrefixedBucket.objectURL(rw.object.staged),
+			DestinationURL: rw.dstURL,
+			Completed:      completed,
+			Promoted:       rw.object.promoted,
+		})
+	}
+
+	return objects, nil
+}
+
+// StagingURL returns the URL of the prefix the objects written to dstURL are
+// staged under before being promoted.
+func StagingURL(dstURL string) (string, error) {
+	dstPrefixedBucket, err := bucketFromObjectURL(dstURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse destination URL: %w", err)
+	}
+
+	return stagingBucket(dstPrefixedBucket).URL(), nil
+}
@@ -5,52 +5,45 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"optable-pair-cli/pkg/metrics"
 
-	"cloud.google.com/go/storage"
 	"github.com/rs/zerolog"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"gocloud.dev/blob"
 )
 
 var (
 	ErrInvalidBucketOptions = errors.New("invalid bucket options")
 	ErrTokenRequired        = errors.New("downscopedToken is required")
+	ErrInvalidObjectURL     = errors.New("invalid object URL")
+	// ErrPermissionDenied is returned when the storage rejects the credentials or denies access to an object.
+	ErrPermissionDenied = errors.New("permission denied by storage")
+	// ErrObjectNotCompleted is returned when an object was not completely written from its source object.
+	ErrObjectNotCompleted = errors.New("object not completed")
 )
 
 type (
 
-	// Readers contains the storage client and readers from two source buckets.
+	// Readers contains the readers from two source buckets.
 	Readers struct {
-		client            *storage.Client
-		AdvReader         []io.ReadCloser
-		PubReader         []io.ReadCloser
+		advBucket  *blob.Bucket
+		pubBucket  *blob.Bucket
+		AdvReader  []io.ReadCloser
+		PubReader  []io.ReadCloser
+		ObjectURLs []string
+		// PubSize is the size in bytes of the publisher data, 0 when unknown as
+		// some of it is compressed.
+		PubSize int64
+		// PubObjects describes the publisher objects read, in the order of PubReader.
+		PubObjects        []Object
 		AdvPrefixedBucket *PrefixedBucket
 		PubPrefixedBucket *PrefixedBucket
-		PubFileReader     io.Reader
+		PubFileReaders    []io.Reader
 	}
 )
 
-func NewReaders(ctx context.Context, downScopedToken, advURL string, opts ...Option) (*Readers, error) {
-	if downScopedToken == "" {
-		return nil, errors.New("downscopedToken is required")
-	}
-
-	client, err := storage.NewClient(
-		ctx,
-		option.WithTokenSource(
-			oauth2.StaticTokenSource(
-				&oauth2.Token{
-					AccessToken: downScopedToken,
-				},
-			),
-		),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
-	}
-
+// NewReaders opens a reader for each object of the advertiser and publisher source buckets, accessed through
+// the client. Caller needs to call Close() on the returned Readers to release resources, and then on the client.
+func NewReaders(ctx context.Context, client *Client, advURL string, opts ...Option) (*Readers, error) {
 	bucketOption := &bucketOptions{}
 	for _, opt := range opts {
 		opt(bucketOption)
@@ -61,22 +54,28 @@ func NewReaders(ctx context.Context, downScopedToken, advURL string, opts ...Opt
 		return nil, fmt.Errorf("failed to parse destination URL: %w", err)
 	}
 
+	advBucket, err := client.open(ctx, advPrefixedBucket)
+	if err != nil {
+		return nil, err
+	}
+
 	bucket := &Readers{
-		client:            client,
+		advBucket:         advBucket,
 		AdvPrefixedBucket: advPrefixedBucket,
 	}
 
-	if pubURL := bucketOption.sourceURL; pubURL != "" {
+	if readers := bucketOption.readers; len(readers) > 0 {
+		bucket.PubFileReaders = readers
+	} else if pubURL := bucketOption.sourceURL; pubURL != "" {
 		pubPrefixedBucket, err := bucketFromObjectURL(pubURL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse destination URL: %w", err)
 		}
 
 		bucket.PubPrefixedBucket = pubPrefixedBucket
-	}
-
-	if reader := bucketOption.reader; reader != nil {
-		bucket.PubFileReader = reader
+		if bucket.pubBucket, err = client.open(ctx, pubPrefixedBucket); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := bucket.newObjectReaders(ctx); err != nil {
@@ -89,15 +88,21 @@ func NewReaders(ctx context.Context, downScopedToken, advURL string, opts ...Opt
 // newObjectReaders lists the objects specified by the advPrefixedBucket and pubPrefixedBucket and opens a reader for each object,
 // except for the .Completed file.
 func (b *Readers) newObjectReaders(ctx context.Context) error {
-	advReaders, err := ReadersFromPrefixedBucket(ctx, b.client, b.AdvPrefixedBucket)
+	advReaders, advObjects, err := readersFromPrefixedBucket(ctx, b.advBucket, b.AdvPrefixedBucket)
 	if err != nil {
 		return err
 	}
 
 	b.AdvReader = advReaders
+	for _, obj := range advObjects {
+		b.ObjectURLs = append(b.ObjectURLs, obj.URL)
+	}
 
-	if b.PubFileReader != nil {
-		b.PubReader = []io.ReadCloser{io.NopCloser(b.PubFileReader)}
+	if len(b.PubFileReaders) > 0 {
+		b.PubReader = make([]io.ReadCloser, len(b.PubFileReaders))
+		for i, r := range b.PubFileReaders {
+			b.PubReader[i] = io.NopCloser(r)
+		}
 		return nil
 	}
 
@@ -105,50 +110,106 @@ func (b *Readers) newObjectReaders(ctx context.Context) error {
 		return errors.New("missing publisher bucket URL")
 	}
 
-	pubReaders, err := ReadersFromPrefixedBucket(ctx, b.client, b.PubPrefixedBucket)
+	pubReaders, pubObjects, err := readersFromPrefixedBucket(ctx, b.pubBucket, b.PubPrefixedBucket)
 	if err != nil {
 		return err
 	}
 
 	b.PubReader = pubReaders
+	b.PubObjects = pubObjects
+	for _, obj := range pubObjects {
+		b.ObjectURLs = append(b.ObjectURLs, obj.URL)
+		b.PubSize += obj.Size
+	}
+	for _, obj := range pubObjects {
+		if obj.Compressed {
+			b.PubSize = 0
+			break
+		}
+	}
 
 	return nil
 }
 
-func ReadersFromPrefixedBucket(ctx context.Context, client *storage.Client, pBucket *PrefixedBucket) ([]io.ReadCloser, error) {
-	logger := zerolog.Ctx(ctx)
-	query := &storage.Query{Prefix: pBucket.Prefix + "/"}
+// ReadersFromPrefixedBucket opens a reader for each data object of the prefixed bucket, accessed through the client.
+func ReadersFromPrefixedBucket(ctx context.Context, client *Client, pBucket *PrefixedBucket) ([]io.ReadCloser, error) {
+	bucket, err := client.open(ctx, pBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	readers, _, err := readersFromPrefixedBucket(ctx, bucket, pBucket)
+	return readers, err
+}
 
-	bucket := client.Bucket(pBucket.Bucket)
+// readersFromPrefixedBucket opens a reader for each data object of the prefixed bucket and
+// returns the readers along with the objects. In GCS, each reader reads the generation of the
+// object listed, so that the data read is the one described by the object. The gzip-compressed
+// objects are decompressed.
+func readersFromPrefixedBucket(ctx context.Context, bucket *blob.Bucket, pBucket *PrefixedBucket) ([]io.ReadCloser, []Object, error) {
+	logger := zerolog.Ctx(ctx)
 
-	it := bucket.Objects(ctx, query)
-	var readers []io.ReadCloser
+	it := bucket.List(&blob.ListOptions{Prefix: pBucket.Prefix + "/"})
+	var (
+		readers []io.ReadCloser
+		objects []Object
+	)
 
 	for {
-		obj, err := it.Next()
-		if errors.Is(err, iterator.Done) {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
 			break
 		} else if err != nil {
 			logger.Debug().Err(err).Msgf("failed to list objects from source bucket %s", pBucket.Prefix)
-			return nil, err
+			return nil, nil, storageError(err)
 		}
 
-		if strings.HasSuffix(obj.Name, CompletedFile) || strings.HasSuffix(obj.Name, "/") || obj.Size == 0 {
+		if !isDataObject(obj) {
 			continue
 		}
 
-		r, err := bucket.Object(obj.Name).NewReader(ctx)
+		stored, err := bucket.NewReader(ctx, obj.Key, pinVersion(obj))
 		if err != nil {
-			return nil, err
+			return nil, nil, storageError(err)
+		}
+
+		url := pBucket.objectURL(obj.Key)
+		r, compressed, err := decompress(traceReader(ctx, url, metrics.StorageReader(stored)))
+		if err != nil {
+			_ = stored.Close()
+			return nil, nil, fmt.Errorf("failed to read %s: %w", url, err)
 		}
 
 		readers = append(readers, r)
+		objects = append(objects, Object{
+			URL:        url,
+			Size:       obj.Size,
+			CRC32C:     objectCRC32C(obj),
+			Compressed: compressed,
+			listed:     obj,
+		})
+	}
+
+	return readers, objects, nil
+}
+
+// NewPubStoredReader opens another reader of the publisher object, of the
+// version read by PubReader, which reads its data as stored, without
+// decompressing it.
+func (b *Readers) NewPubStoredReader(ctx context.Context, obj Object) (io.ReadCloser, error) {
+	if obj.listed == nil || b.pubBucket == nil {
+		return nil, fmt.Errorf("%w: %s is not a publisher object", ErrInvalidBucketOptions, obj.URL)
 	}
 
-	return readers, nil
+	stored, err := b.pubBucket.NewReader(ctx, obj.listed.Key, pinVersion(obj.listed))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return traceReader(ctx, obj.URL, metrics.StorageReader(stored)), nil
 }
 
-// Close closes the client and all read writers.
+// Close closes all the readers.
 func (b *Readers) Close() error {
 	for _, rc := range b.AdvReader {
 		if err := rc.Close(); err != nil {
@@ -162,5 +223,5 @@ func (b *Readers) Close() error {
 		}
 	}
 
-	return b.client.Close()
+	return nil
 }
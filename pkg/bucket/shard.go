@@ -0,0 +1,254 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"gocloud.dev/blob"
+	"golang.org/x/sync/errgroup"
+)
+
+// shardWriter writes CSV records to numbered objects, staged under stg and
+// promoted to dst. The records are written through lanes, each uploading its
+// own objects concurrently with the other lanes, and rolling over to the next
+// numbered object at a line boundary once the current one holds maxRows rows
+// or maxSize bytes. Without limits, it writes a single object through a
+// single lane.
+type shardWriter struct {
+	// ctx is the context of the object writers, cancelled to abort them.
+	ctx    context.Context
+	bucket *blob.Bucket
+	stg    *PrefixedBucket
+	dst    *PrefixedBucket
+	name   func(shard int) string
+	// metadata of the objects, recording their source.
+	metadata map[string]string
+	maxRows  int64
+	maxSize  int64
+	// compress writes the objects gzip-compressed.
+	compress bool
+	lanes    []*shardLane
+
+	mu        sync.Mutex // guards urls, objects and committed, appended by the lanes
+	urls      []string
+	objects   []*stagedObject
+	committed []string
+}
+
+// shardLane writes CSV records to the numbered objects of a shardWriter, one
+// after the other. A lane is not safe for concurrent use, but the lanes of a
+// shardWriter are written concurrently.
+type shardLane struct {
+	w          *shardWriter
+	current    io.WriteCloser
+	currentObj *stagedObject
+	rows       int64
+	size       int64
+	midLine    bool
+}
+
+// newShardWriter creates a shardWriter with up to uploads lanes when the
+// objects are limited in rows or size, or a single lane otherwise.
+func newShardWriter(ctx context.Context, bucket *blob.Bucket, stg, dst *PrefixedBucket, name func(shard int) string, metadata map[string]string, maxRows, maxSize int64, compress bool, uploads int) *shardWriter {
+	w := &shardWriter{
+		ctx:      ctx,
+		bucket:   bucket,
+		stg:      stg,
+		dst:      dst,
+		name:     name,
+		metadata: metadata,
+		maxRows:  maxRows,
+		maxSize:  maxSize,
+		compress: compress,
+	}
+
+	if uploads < 1 || (maxRows <= 0 && maxSize <= 0) {
+		uploads = 1
+	}
+	for range uploads {
+		w.lanes = append(w.lanes, &shardLane{w: w})
+	}
+
+	return w
+}
+
+// Write writes to the first lane.
+func (w *shardWriter) Write(p []byte) (int, error) {
+	return w.lanes[0].Write(p)
+}
+
+// writers returns the lanes, to write concurrently.
+func (w *shardWriter) writers() []io.Writer {
+	writers := make([]io.Writer, len(w.lanes))
+	for i, lane := range w.lanes {
+		writers[i] = lane
+	}
+
+	return writers
+}
+
+func (l *shardLane) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.current == nil || (l.full() && !l.midLine) {
+			if err := l.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := l.current.Write(p[:l.fit(p)])
+		written += n
+		l.size += int64(n)
+		l.rows += int64(bytes.Count(p[:n], []byte{'\n'}))
+		if n > 0 {
+			l.midLine = p[n-1] != '\n'
+		}
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// full returns whether the current object reached one of the limits.
+func (l *shardLane) full() bool {
+	return (l.w.maxRows > 0 && l.rows >= l.w.maxRows) || (l.w.maxSize > 0 && l.size >= l.w.maxSize)
+}
+
+// fit returns the length of the beginning of p to write to the current object:
+// up to the end of the line which fills it, or all of p.
+func (l *shardLane) fit(p []byte) int {
+	if l.w.maxRows <= 0 && l.w.maxSize <= 0 {
+		return len(p)
+	}
+
+	rows := l.rows
+	for i := 0; i < len(p); {
+		j := bytes.IndexByte(p[i:], '\n')
+		if j < 0 {
+			break
+		}
+
+		i += j + 1
+		rows++
+		if (l.w.maxRows > 0 && rows >= l.w.maxRows) || (l.w.maxSize > 0 && l.size+int64(i) >= l.w.maxSize) {
+			return i
+		}
+	}
+
+	return len(p)
+}
+
+// rotate commits the current object of the lane, if any, and opens the next
+// numbered object.
+func (l *shardLane) rotate() error {
+	if err := l.commit(); err != nil {
+		return err
+	}
+
+	obj := l.w.next()
+	writer, err := obj.newWriter(l.w.ctx, l.w.metadata)
+	if err != nil {
+		return err
+	}
+
+	l.currentObj = obj
+	l.current = traceWriter(l.w.ctx, l.w.stg.objectURL(obj.staged), writer)
+	l.rows, l.size, l.midLine = 0, 0, false
+	return nil
+}
+
+// commit closes the current object of the lane, if any.
+func (l *shardLane) commit() error {
+	if l.current == nil {
+		return nil
+	}
+
+	current, obj := l.current, l.currentObj
+	l.current = nil
+	if err := current.Close(); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", l.w.stg.objectURL(obj.staged), err)
+	}
+
+	l.w.mu.Lock()
+	l.w.committed = append(l.w.committed, obj.staged)
+	l.w.mu.Unlock()
+
+	return nil
+}
+
+// next returns the next numbered object.
+func (w *shardWriter) next() *stagedObject {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var (
+		name    = w.name(len(w.urls))
+		stgName = w.stg.Prefix + "/" + name
+		dstName = w.dst.Prefix + "/" + name
+		obj     = &stagedObject{
+			bucket:   w.bucket,
+			staged:   stgName,
+			final:    dstName,
+			url:      w.dst.objectURL(dstName),
+			compress: w.compress,
+		}
+	)
+	w.urls = append(w.urls, obj.url)
+	w.objects = append(w.objects, obj)
+
+	return obj
+}
+
+// Close commits the last object of each lane, or an empty one if nothing was
+// written. If any of them fails, the others are deleted.
+func (w *shardWriter) Close() error {
+	if len(w.urls) == 0 {
+		if err := w.lanes[0].rotate(); err != nil {
+			return err
+		}
+	}
+
+	var g errgroup.Group
+	for _, lane := range w.lanes {
+		g.Go(lane.commit)
+	}
+
+	if err := g.Wait(); err != nil {
+		w.deleteCommitted()
+		return err
+	}
+
+	return nil
+}
+
+// abort aborts the uploads in progress and deletes the objects already
+// committed, so that no partial data is left. The context of the writers must
+// be cancelled beforehand.
+func (w *shardWriter) abort() {
+	for _, lane := range w.lanes {
+		if lane.current != nil {
+			// closing a writer once its context is cancelled does not commit the object.
+			_ = lane.current.Close()
+			lane.current = nil
+		}
+	}
+
+	w.deleteCommitted()
+}
+
+// deleteCommitted deletes the objects committed so far, even once the context
+// of the writers is cancelled.
+func (w *shardWriter) deleteCommitted() {
+	ctx := context.WithoutCancel(w.ctx)
+	for _, key := range w.committed {
+		_ = w.bucket.Delete(ctx, key)
+	}
+	w.committed = nil
+}
@@ -0,0 +1,363 @@
+package bucket
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"optable-pair-cli/pkg/metrics"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog"
+	"gocloud.dev/blob"
+)
+
+// stagingDir is the folder of the destination prefix the objects are written
+// to before being promoted. It stays within the path configured by the clean
+// room, and like the .Completed and .Manifest.json markers its name starts
+// with a dot: the objects under it are not PAIR data, and are ignored by the
+// listings of opair and the publisher alike.
+const stagingDir = ".staging"
+
+var (
+	// ErrChecksumMismatch is returned when a staged object does not hold the data written to it.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrForeignObject is returned when the destination prefix holds an object
+	// which was not written by opair from the sources being written.
+	ErrForeignObject = errors.New("object not written by opair from the same source")
+)
+
+type (
+	// stagedObject is an object written under the staging prefix, promoted to
+	// its final name under the destination prefix once all the objects are
+	// written and verified.
+	stagedObject struct {
+		bucket   *blob.Bucket
+		staged   string
+		final    string
+		url      string
+		promoted bool
+		// compress writes the object gzip-compressed.
+		compress bool
+		// writer of the data written, nil when written by a previous run.
+		writer *objectWriter
+	}
+
+	// checksumWriter computes the size, the CRC32C, the MD5 and the SHA-256
+	// of the data written through it, as stored.
+	checksumWriter struct {
+		io.WriteCloser
+		crc  hash.Hash32
+		md5  hash.Hash
+		sha  hash.Hash
+		size int64
+	}
+
+	// objectWriter writes the rows of an object to its checksum writer,
+	// gzip-compressed when required, and counts them.
+	objectWriter struct {
+		w        io.Writer
+		gzip     *gzip.Writer
+		checksum *checksumWriter
+		rows     int64
+	}
+)
+
+func newChecksumWriter(w io.WriteCloser) *checksumWriter {
+	return &checksumWriter{
+		WriteCloser: w,
+		crc:         crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		md5:         md5.New(),
+		sha:         sha256.New(),
+	}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.crc.Write(p[:n])
+	w.md5.Write(p[:n])
+	w.sha.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.rows += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+// Close flushes the compressed data, if any, and commits the object.
+func (w *objectWriter) Close() error {
+	if w.gzip != nil {
+		if err := w.gzip.Close(); err != nil {
+			_ = w.checksum.Close()
+			return err
+		}
+	}
+
+	return w.checksum.Close()
+}
+
+// newWriter opens the writer of the staged object, with the given metadata.
+func (o *stagedObject) newWriter(ctx context.Context, metadata map[string]string) (*objectWriter, error) {
+	opts := &blob.WriterOptions{Metadata: metadata}
+	if o.compress {
+		opts.ContentType = "application/gzip"
+	}
+
+	w, err := o.bucket.NewWriter(ctx, o.staged, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", o.url, storageError(err))
+	}
+
+	checksum := newChecksumWriter(metrics.StorageWriter(w))
+	o.writer = &objectWriter{w: checksum, checksum: checksum}
+	if o.compress {
+		o.writer.gzip = gzip.NewWriter(checksum)
+		o.writer.w = o.writer.gzip
+	}
+
+	return o.writer, nil
+}
+
+// stagingBucket returns the prefixed bucket the objects of dst are staged under.
+func stagingBucket(dst *PrefixedBucket) *PrefixedBucket {
+	return &PrefixedBucket{
+		Scheme: dst.Scheme,
+		Bucket: dst.Bucket,
+		Prefix: dst.Prefix + "/" + stagingDir,
+	}
+}
+
+// verify checks that the object is staged, or already promoted, and that it
+// holds the data written to it by this run, if any.
+func (o *stagedObject) verify(ctx context.Context) error {
+	if o.promoted {
+		return nil
+	}
+
+	attrs, err := o.bucket.Attributes(ctx, o.staged)
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s is not staged", ErrObjectNotCompleted, o.url)
+	} else if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", o.url, storageError(err))
+	}
+
+	if o.writer == nil {
+		return nil
+	}
+
+	checksum := o.writer.checksum
+	if attrs.Size != checksum.size {
+		return fmt.Errorf("%w: %s holds %d bytes, %d bytes were written",
+			ErrChecksumMismatch, o.url, attrs.Size, checksum.size)
+	}
+
+	// the storages provide the MD5 checksum of the objects, but for the GCS
+	// composite objects, and GCS also provides their CRC32C checksum.
+	if sum := checksum.md5.Sum(nil); len(attrs.MD5) > 0 && !bytes.Equal(attrs.MD5, sum) {
+		return fmt.Errorf("%w: %s holds data with MD5 %x, data with MD5 %x was written",
+			ErrChecksumMismatch, o.url, attrs.MD5, sum)
+	}
+
+	var gcsAttrs storage.ObjectAttrs
+	if attrs.As(&gcsAttrs) && gcsAttrs.CRC32C != checksum.crc.Sum32() {
+		return fmt.Errorf("%w: %s holds data with CRC32C %08x, data with CRC32C %08x was written",
+			ErrChecksumMismatch, o.url, gcsAttrs.CRC32C, checksum.crc.Sum32())
+	}
+
+	return nil
+}
+
+// promote copies the staged object to its final name. The staged object is
+// deleted by deleteStaged once all the objects are promoted.
+func (o *stagedObject) promote(ctx context.Context) error {
+	if err := o.bucket.Copy(ctx, o.final, o.staged, nil); err != nil {
+		return fmt.Errorf("failed to promote %s: %w", o.url, storageError(err))
+	}
+	o.promoted = true
+
+	return nil
+}
+
+// unpromote deletes the promoted object, even once the context is cancelled.
+func (o *stagedObject) unpromote(ctx context.Context) {
+	if err := o.bucket.Delete(context.WithoutCancel(ctx), o.final); err != nil && !isNotFound(err) {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("failed to delete %s, promoted by the failed attempt", o.url)
+		return
+	}
+	o.promoted = false
+}
+
+// deleteStaged deletes the staged object once promoted.
+func (o *stagedObject) deleteStaged(ctx context.Context) error {
+	if err := o.bucket.Delete(ctx, o.staged); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete staged %s: %w", o.url, storageError(err))
+	}
+
+	return nil
+}
+
+// StoredChecksum returns the size and the hex SHA-256 checksum of the data
+// of the object as stored, gzip-compressed or not. They are only known for
+// an object written by this run, once committed.
+func (rw *ReadWriteCloser) StoredChecksum() (int64, string, bool) {
+	if rw.object == nil || rw.object.writer == nil {
+		return 0, "", false
+	}
+
+	checksum := rw.object.writer.checksum
+	return checksum.size, hex.EncodeToString(checksum.sha.Sum(nil)), true
+}
+
+// objects returns the staged objects written by the ReadWriteCloser.
+func (rw *ReadWriteCloser) objects() []*stagedObject {
+	if rw.shards != nil {
+		return rw.shards.objects
+	}
+
+	return []*stagedObject{rw.object}
+}
+
+// Promote commits the objects not committed yet under the staging prefix,
+// verifies their sizes and checksums, and promotes them to the destination
+// prefix. It fails without changing the destination prefix when it holds an
+// object which was not written from the sources of the ReadWriter, as recorded
+// in its metadata. The objects are all copied before any of them is deleted
+// from the staging prefix, and the copies are deleted if one of them fails.
+// The objects left under the destination prefix by earlier attempts from the
+// same sources are deleted once all the objects are promoted. Until Promote is
+// called, the destination prefix is left untouched.
+func (b *ReadWriter) Promote(ctx context.Context) error {
+	for _, rw := range b.ReadWriters {
+		if err := rw.Commit(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		objects []*stagedObject
+		keep    = make(map[string]bool)
+	)
+	for _, rw := range b.ReadWriters {
+		for _, o := range rw.objects() {
+			if err := o.verify(ctx); err != nil {
+				return err
+			}
+
+			objects = append(objects, o)
+			keep[o.final] = o.promoted
+		}
+	}
+
+	stale, err := b.staleObjects(ctx, keep)
+	if err != nil {
+		return err
+	}
+
+	var promoted []*stagedObject
+	for _, o := range objects {
+		if o.promoted {
+			continue
+		}
+
+		if err := o.promote(ctx); err != nil {
+			for _, p := range promoted {
+				p.unpromote(ctx)
+			}
+			return err
+		}
+		promoted = append(promoted, o)
+	}
+
+	logger := zerolog.Ctx(ctx)
+	for _, key := range stale {
+		logger.Warn().Msgf("deleting %s, left by an earlier attempt", b.dstPrefixedBucket.objectURL(key))
+		if err := b.dst.Delete(ctx, key); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", b.dstPrefixedBucket.objectURL(key), storageError(err))
+		}
+	}
+
+	for _, o := range objects {
+		if err := o.deleteStaged(ctx); err != nil {
+			return err
+		}
+	}
+
+	return b.clearStaging(ctx)
+}
+
+// staleObjects returns the objects under the destination prefix left by
+// earlier attempts from the sources of the ReadWriter, which are neither
+// promoted nor about to be overwritten: keep holds the final names of the
+// objects, set when already promoted. It fails with ErrForeignObject when an
+// object was not written from these sources.
+func (b *ReadWriter) staleObjects(ctx context.Context, keep map[string]bool) ([]string, error) {
+	var stale []string
+
+	it := b.dst.List(&blob.ListOptions{Prefix: b.dstPrefixedBucket.Prefix + "/"})
+	for {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return stale, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list objects from bucket %s: %w", b.dstPrefixedBucket.URL(), storageError(err))
+		}
+
+		if isMarker(obj.Key) || isStaged(obj.Key) || obj.IsDir || strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+
+		promoted, ok := keep[obj.Key]
+		if promoted {
+			continue
+		}
+
+		attrs, err := b.dst.Attributes(ctx, obj.Key)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get the attributes of %s: %w", b.dstPrefixedBucket.objectURL(obj.Key), storageError(err))
+		}
+
+		if source, written := attrs.Metadata[metadataSource]; !written || !b.isOwnSource(source) {
+			return nil, fmt.Errorf("%w: %s is in the way, remove it or write to another prefix", ErrForeignObject, b.dstPrefixedBucket.objectURL(obj.Key))
+		}
+
+		// the objects about to be overwritten are not stale.
+		if !ok {
+			stale = append(stale, obj.Key)
+		}
+	}
+}
+
+// clearStaging deletes the objects left under the staging prefix, which only
+// holds objects written by opair.
+func (b *ReadWriter) clearStaging(ctx context.Context) error {
+	it := b.dst.List(&blob.ListOptions{Prefix: b.stgPrefixedBucket.Prefix + "/"})
+	for {
+		obj, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to list objects from bucket %s: %w", b.stgPrefixedBucket.URL(), storageError(err))
+		}
+
+		if obj.IsDir {
+			continue
+		}
+
+		if err := b.dst.Delete(ctx, obj.Key); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", b.stgPrefixedBucket.objectURL(obj.Key), storageError(err))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bucket
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/azureblob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+	"google.golang.org/api/googleapi"
+)
+
+// The PAIR data is accessed through gocloud.dev blob, so that clean rooms
+// can store it in GCS, S3, Azure Blob Storage or on the local filesystem.
+var schemes = map[string]bool{
+	gcsblob.Scheme:   true,
+	s3blob.Scheme:    true,
+	azureblob.Scheme: true,
+	fileblob.Scheme:  true,
+}
+
+// storageError marks the authentication and authorization errors of the storage with ErrPermissionDenied.
+func storageError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden) {
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	}
+
+	if err != nil && gcerrors.Code(err) == gcerrors.PermissionDenied {
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	}
+
+	return err
+}
+
+// isNotFound returns whether the error tells that the object does not exist.
+// GCS denies access to objects which may not exist, which is not reported.
+func isNotFound(err error) bool {
+	return gcerrors.Code(err) == gcerrors.NotFound && !errors.Is(storageError(err), ErrPermissionDenied)
+}
+
+// objectVersion returns a version of the object listed, which changes when
+// it is overwritten: its generation in GCS, its MD5 checksum or its
+// modification time otherwise.
+func objectVersion(obj *blob.ListObject) string {
+	var attrs storage.ObjectAttrs
+	if obj.As(&attrs) {
+		return strconv.FormatInt(attrs.Generation, 10)
+	}
+
+	if len(obj.MD5) == md5.Size {
+		return hex.EncodeToString(obj.MD5)
+	}
+
+	return obj.ModTime.UTC().Format(time.RFC3339Nano)
+}
+
+// objectCRC32C returns the CRC32C checksum of the object listed, in hex, when
+// the storage provides one.
+func objectCRC32C(obj *blob.ListObject) string {
+	var attrs storage.ObjectAttrs
+	if obj.As(&attrs) {
+		return fmt.Sprintf("%08x", attrs.CRC32C)
+	}
+
+	return ""
+}
+
+// pinVersion makes a reader read the generation of the object listed, when
+// the storage supports it, so that the data read is the one listed.
+func pinVersion(obj *blob.ListObject) *blob.ReaderOptions {
+	var attrs storage.ObjectAttrs
+	if !obj.As(&attrs) {
+		return nil
+	}
+
+	return &blob.ReaderOptions{
+		BeforeRead: func(as func(any) bool) error {
+			var handle **storage.ObjectHandle
+			if as(&handle) {
+				*handle = (*handle).Generation(attrs.Generation)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"optable-pair-cli/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// tracedReadCloser records the read of an object as a span, from its opening to its closing.
+	// As the wrapper of the object reader, it also marks its permission errors.
+	tracedReadCloser struct {
+		io.ReadCloser
+		span trace.Span
+		n    int64
+	}
+
+	// tracedWriteCloser records the write of an object as a span, from its opening to its closing.
+	// As the wrapper of the object writer, it also marks its permission errors.
+	tracedWriteCloser struct {
+		io.WriteCloser
+		span trace.Span
+		n    int64
+	}
+)
+
+func traceReader(ctx context.Context, url string, r io.ReadCloser) io.ReadCloser {
+	_, span := tracing.Start(ctx, "bucket.read", attribute.String("object", url))
+	return &tracedReadCloser{ReadCloser: r, span: span}
+}
+
+func traceWriter(ctx context.Context, url string, w io.WriteCloser) io.WriteCloser {
+	_, span := tracing.Start(ctx, "bucket.write", attribute.String("object", url))
+	return &tracedWriteCloser{WriteCloser: w, span: span}
+}
+
+func (r *tracedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, storageError(err)
+}
+
+func (r *tracedReadCloser) Close() error {
+	err := storageError(r.ReadCloser.Close())
+	r.span.SetAttributes(attribute.Int64("bytes", r.n))
+	tracing.End(r.span, err)
+	return err
+}
+
+func (w *tracedWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n += int64(n)
+	return n, storageError(err)
+}
+
+func (w *tracedWriteCloser) Close() error {
+	err := storageError(w.WriteCloser.Close())
+	w.span.SetAttributes(attribute.Int64("bytes", w.n))
+	tracing.End(w.span, err)
+	return err
+}
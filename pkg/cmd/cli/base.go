@@ -2,14 +2,37 @@ package cli
 
 import (
 	"context"
+	"fmt"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/internal"
+	"optable-pair-cli/pkg/metrics"
+	"optable-pair-cli/pkg/progress"
+	"optable-pair-cli/pkg/tracing"
+	"os"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
 type CmdContext struct {
-	ctx        context.Context
-	config     *Config
-	keyContext string
+	ctx          context.Context
+	config       *Config
+	keyContext   string
+	profile      string
+	apiFlags     APIFlags
+	storageFlags StorageFlags
+	stepTimeout  time.Duration
+	pollPolicy   internal.PollPolicy
+	progress     progress.Mode
+	redactor     *redactingWriter
+	closers      []func()
+	// interrupt cancels the context of the command as if it received the signal.
+	interrupt func(os.Signal)
+	// resumable is set by the commands running PAIR steps, which can be resumed once interrupted.
+	resumable bool
+	// cleanroomToken is the clean room token argument of a resumable command,
+	// left out of the resume command.
+	cleanroomToken string
 }
 
 type (
@@ -17,36 +40,142 @@ type (
 		Get     GetCmd     `cmd:"" help:"Get the current status and configuration associated with the specified Optable PAIR clean room."`
 		Run     RunCmd     `cmd:"" help:"As the advertiser clean room, run the PAIR match protocol with the publisher that has invited you to the specified Optable PAIR clean room."`
 		Decrypt DecryptCmd `cmd:"" help:"Decrypt a list of previously matched triple encrypted PAIR IDs using the advertiser clean room's private key."`
+
+		Encrypt   EncryptCmd   `cmd:"" help:"Run step 1 of the PAIR protocol only: encrypt and send the advertiser data."`
+		ReEncrypt ReEncryptCmd `cmd:"" name:"reencrypt" help:"Run step 2 of the PAIR protocol only: re-encrypt and send the publisher data."`
+		Match     MatchCmd     `cmd:"" help:"Run step 3 of the PAIR protocol only: match the triple encrypted data and decrypt the intersection."`
+
+		Manifest ManifestCmd `cmd:"" help:"Inspect the manifests written alongside the PAIR data uploaded to the clean room."`
+		Verify   VerifyCmd   `cmd:"" help:"Audit the PAIR data stored for the specified Optable PAIR clean room, without changing it, and print a pass/fail report."`
 	}
 
 	KeyCmd struct {
 		Create CreateCmd `cmd:"" help:"Generate a new advertiser clean room private key and store it locally."`
 	}
+
+	// PollFlags configures how opair polls the clean room while waiting for the publisher.
+	PollFlags struct {
+		Interval    time.Duration `default:"1s" help:"The delay between the first two polls of the clean room state while waiting for the publisher."`
+		Backoff     float64       `default:"1" help:"The factor by which the delay between two polls grows after each poll. A factor of 1 polls at a constant interval."`
+		MaxInterval time.Duration `default:"1m" help:"The maximum delay between two polls of the clean room state."`
+		Timeout     time.Duration `default:"1h" help:"The maximum time to wait for the publisher to advance the clean room state, e.g. to re-encrypt the advertiser data before the match. The wait of run --wait is bounded by --wait-timeout instead."`
+	}
+	// APIFlags configures the client of the Optable API.
+	APIFlags struct {
+		Endpoint string        `help:"Override the Optable API endpoint found in the clean room token, e.g. to go through a proxy."`
+		Timeout  time.Duration `default:"1m" help:"The timeout of each request to the Optable API."`
+	}
+	// StorageFlags configures the client of the clean room storage.
+	StorageFlags struct {
+		Endpoint string `help:"Send the requests to GCS to this endpoint instead, e.g. to go through a proxy."`
+	}
 	Cli struct {
-		Verbose int `short:"v" type:"counter" help:"Enable debug mode."`
+		Verbose       int           `short:"v" type:"counter" help:"Enable debug mode."`
+		Profile       string        `help:"The profile of the configuration file to use. Defaults to the current-profile of the file, or default."`
+		Progress      string        `default:"auto" enum:"auto,bar,log,none" help:"How to report the progress of long running steps: a progress bar (bar), periodic log lines (log), or none. auto renders a progress bar when stderr is a terminal, and logs otherwise."`
+		TraceEndpoint string        `help:"The OTLP/HTTP endpoint, e.g. http://localhost:4318, to export the traces of the command to. The OTEL_EXPORTER_OTLP_* environment variables are also honored."`
+		TraceFile     string        `type:"path" help:"The path of a local file to export the traces of the command to, as JSON."`
+		MetricsAddr   string        `help:"The address, e.g. localhost:9090, of a local HTTP server to start for the duration of the command, serving Prometheus metrics on /metrics and runtime profiles on /debug/pprof."`
+		Timeout       time.Duration `help:"The maximum duration of the command, e.g. 12h. Unlimited by default."`
+		StepTimeout   time.Duration `help:"The maximum duration of each step of the PAIR protocol, including the wait for the publisher before matching. Unlimited by default."`
 
 		Version VersionCmd `cmd:"" help:"Print utility version"`
 
 		CleanroomCmd      CleanroomCmd `cmd:"" name:"cleanroom" help:"Commands for interacting with Optable PAIR clean rooms."`
 		AdvertiserKeyPath string       `cmd:"" short:"k" name:"keypath" help:"The path to the advertiser clean room's private key to use for the operation. If not provided, the key saved in the configuration file will be used."`
 		KeyCmd            KeyCmd       `cmd:"" name:"key" help:"Commands for managing advertiser clean room private keys."`
+		ConfigCmd         ConfigCmd    `cmd:"" name:"config" help:"Commands for managing the profiles of the opair configuration file."`
 		Context           string       `short:"c" help:"Context name to use" default:"default"`
+		Poll              PollFlags    `embed:"" prefix:"poll-" group:"Polling"`
+		API               APIFlags     `embed:"" prefix:"api-" group:"API"`
+		Storage           StorageFlags `embed:"" prefix:"storage-" group:"Storage"`
+		Log               LogFlags     `embed:"" prefix:"log-" group:"Logging"`
 	}
 )
 
 func (c *Cli) NewContext(conf *Config) (*CmdContext, error) {
+	w, closeLog := c.Log.writer()
+	redactor := newRedactingWriter(w)
+	logger := newLogger("opair", c.Verbose, redactor)
+
 	cliCtx := &CmdContext{
-		ctx:        NewLogger("opair", c.Verbose).WithContext(context.Background()),
-		config:     conf,
-		keyContext: c.Context,
+		ctx:          logger.WithContext(context.Background()),
+		redactor:     redactor,
+		closers:      []func(){closeLog},
+		config:       conf,
+		keyContext:   c.Context,
+		profile:      c.Profile,
+		apiFlags:     c.API,
+		storageFlags: c.Storage,
+		stepTimeout:  c.StepTimeout,
+		pollPolicy:   c.Poll.policy(),
+		progress:     progress.Mode(c.Progress),
+	}
+
+	if err := cliCtx.pollPolicy.Validate(); err != nil {
+		return nil, err
+	}
+
+	shutdownTracing, err := tracing.Setup(cliCtx.ctx, version, c.TraceEndpoint, c.TraceFile)
+	if err != nil {
+		return nil, fmt.Errorf("tracing.Setup: %w", err)
+	}
+	cliCtx.closers = append(cliCtx.closers, shutdownTracing)
+
+	// the root span of the command, the parent of the spans of the steps.
+	ctx, span := tracing.Start(cliCtx.ctx, "opair")
+	cliCtx.ctx = ctx
+	cliCtx.closers = append(cliCtx.closers, func() { span.End() })
+
+	if c.Timeout > 0 {
+		ctx, cancel := context.WithTimeoutCause(cliCtx.ctx, c.Timeout, fmt.Errorf("--timeout of %s exceeded: %w", c.Timeout, context.DeadlineExceeded))
+		cliCtx.ctx = ctx
+		cliCtx.closers = append(cliCtx.closers, cancel)
+	}
+
+	cliCtx.notifyInterrupt()
+
+	if c.MetricsAddr != "" {
+		shutdown, err := metrics.Serve(cliCtx.ctx, c.MetricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("metrics.Serve: %w", err)
+		}
+		cliCtx.closers = append(cliCtx.closers, shutdown)
 	}
 
 	return cliCtx, nil
 }
 
-// Context returns a context.Context that is protected by a timeout accessible
-// via the `--timeout` flag. Each invocation returns a *new* Context and thus
-// resets the timeout.
+// Close releases the resources held for the duration of the command, such as
+// the metrics server and the trace exporters, in the reverse order of their creation.
+func (c *CmdContext) Close() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+}
+
+// policy returns the poll policy from the flags, falling back to the default
+// policy for any unset value.
+func (f PollFlags) policy() internal.PollPolicy {
+	policy := internal.DefaultPollPolicy()
+	if f.Interval > 0 {
+		policy.Interval = f.Interval
+	}
+	if f.Backoff > 0 {
+		policy.Backoff = f.Backoff
+	}
+	if f.MaxInterval > 0 {
+		policy.MaxInterval = f.MaxInterval
+	}
+	if f.Timeout > 0 {
+		policy.Timeout = f.Timeout
+	}
+
+	return policy
+}
+
+// Context returns the context.Context of the command, which is done once the
+// duration set by the `--timeout` flag is exceeded, or on SIGINT or SIGTERM.
 func (c *CmdContext) Context() context.Context {
 	return c.ctx
 }
@@ -55,6 +184,34 @@ func (c *CmdContext) Log() *zerolog.Logger {
 	return zerolog.Ctx(c.ctx)
 }
 
+// redact registers secrets, such as tokens and keys, to redact from the logs.
+func (c *CmdContext) redact(secrets ...string) {
+	c.redactor.add(secrets...)
+}
+
+// clientOptions returns the options used to create clean room clients.
+func (c *CmdContext) clientOptions() []internal.ClientOption {
+	opts := []internal.ClientOption{
+		internal.WithPollPolicy(c.pollPolicy),
+		internal.WithHTTPTimeout(c.apiFlags.Timeout),
+	}
+	if c.apiFlags.Endpoint != "" {
+		opts = append(opts, internal.WithEndpoint(c.apiFlags.Endpoint))
+	}
+
+	return opts
+}
+
+// storageOptions returns the options used to create storage clients.
+func (c *CmdContext) storageOptions() []bucket.ClientOption {
+	var opts []bucket.ClientOption
+	if c.storageFlags.Endpoint != "" {
+		opts = append(opts, bucket.WithEndpoint(c.storageFlags.Endpoint))
+	}
+
+	return opts
+}
+
 type HelpCmd struct{}
 
 func (c *HelpCmd) Run(_ *CmdContext) error {
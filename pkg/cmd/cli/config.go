@@ -69,7 +69,7 @@ func LoadKeyConfig(context, configPath string, strict bool) (*Config, error) {
 	if !strict {
 		return &Config{configPath: configPath}, nil
 	}
-	return nil, errors.New("no key configuration found for the specified context")
+	return nil, ErrKeyNotFound
 }
 
 func (c *CmdContext) SaveConfig(context string) error {
@@ -92,13 +92,22 @@ func (c *CmdContext) SaveConfig(context string) error {
 }
 
 func ReadKeyConfig(context string, config *Config) (string, error) {
-	config, err := LoadKeyConfig(context, config.configPath, true)
+	keyConfig, err := readKeyConfig(context, config)
 	if err != nil {
 		return "", err
 	}
+
+	return keyConfig.Key, nil
+}
+
+func readKeyConfig(context string, config *Config) (*keys.KeyConfig, error) {
+	config, err := LoadKeyConfig(context, config.configPath, true)
+	if err != nil {
+		return nil, err
+	}
 	if config.keyConfig == nil || config.keyConfig.Key == "" {
-		return "", errors.New("malformed key configuration file, please regenerate the key")
+		return nil, ErrMalformedKey
 	}
 
-	return config.keyConfig.Key, nil
+	return config.keyConfig, nil
 }
@@ -38,12 +38,18 @@ func (c *DecryptCmd) Run(cli *CmdContext) error {
 	if err != nil {
 		return fmt.Errorf("ReadKeyConfig: %w", err)
 	}
+	cli.redact(advertiserKey)
 
 	fs, err := io.FileReaders(c.Input)
 	if err != nil {
 		return fmt.Errorf("io.FileReaders: %w", err)
 	}
-	in := io.MultiReader(fs...)
+
+	// large files are split so that they are parsed concurrently.
+	in, err := io.Split(fs, c.NumThreads)
+	if err != nil {
+		return fmt.Errorf("io.Split: %w", err)
+	}
 
 	out, err := io.FileWriter(c.Output)
 	if err != nil {
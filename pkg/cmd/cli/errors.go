@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/internal"
+	"optable-pair-cli/pkg/pair"
+)
+
+var (
+	// ErrTokenRequired is returned when no clean room token is provided.
+	ErrTokenRequired = errors.New("pair clean room token is required")
+	// ErrInvalidState is returned when the states of the clean room participants do not allow to run a step.
+	ErrInvalidState = errors.New("invalid clean room state")
+	// ErrKeyNotFound is returned when no advertiser key is configured for the context.
+	ErrKeyNotFound = errors.New("no key configuration found for the specified context")
+	// ErrMalformedKey is returned when the advertiser key configuration cannot be used.
+	ErrMalformedKey = errors.New("malformed key configuration file, please regenerate the key")
+	// ErrInterrupted is returned when opair is interrupted by SIGINT or SIGTERM.
+	ErrInterrupted = errors.New("interrupted")
+	// ErrTampered is returned when the publisher triple encrypted data stored in GCS differs from the data written by step 2.
+	ErrTampered = errors.New("publisher triple encrypted data tampered with")
+	// ErrVerificationFailed is returned when a check of the clean room storage fails.
+	ErrVerificationFailed = errors.New("clean room verification failed")
+)
+
+// Exit codes of opair, documented in the README. Scripts rely on them, so they must not change.
+const (
+	ExitFailure             = 1
+	ExitInputBelowThreshold = 3
+	ExitInvalidToken        = 4
+	ExitInvalidState        = 5
+	ExitPermissionDenied    = 6
+	ExitTimeout             = 7
+	ExitKeyConfig           = 8
+	ExitAPI                 = 9
+	ExitTampered            = 10
+	ExitVerificationFailed  = 11
+	ExitInterrupted         = 130 // 128+SIGINT, as shells do
+)
+
+// exitError maps the errors matching any of errs to an exit code and a machine-readable error code.
+type exitError struct {
+	errs     []error
+	exitCode int
+	code     string
+}
+
+// exitErrors are matched in order, the first match wins: the most specific errors come first.
+var exitErrors = []exitError{
+	{
+		errs:     []error{ErrInterrupted},
+		exitCode: ExitInterrupted,
+		code:     "interrupted",
+	},
+	{
+		errs:     []error{ErrTampered},
+		exitCode: ExitTampered,
+		code:     "tampered",
+	},
+	{
+		errs:     []error{ErrVerificationFailed},
+		exitCode: ExitVerificationFailed,
+		code:     "verification_failed",
+	},
+	{
+		errs:     []error{pair.ErrInputBelowThreshold},
+		exitCode: ExitInputBelowThreshold,
+		code:     "input_below_threshold",
+	},
+	{
+		errs:     []error{ErrTokenRequired, internal.ErrInvalidToken, internal.ErrUnauthorized},
+		exitCode: ExitInvalidToken,
+		code:     "invalid_token",
+	},
+	{
+		errs:     []error{ErrInvalidState, internal.ErrTerminalState},
+		exitCode: ExitInvalidState,
+		code:     "invalid_state",
+	},
+	{
+		errs:     []error{bucket.ErrPermissionDenied, internal.ErrForbidden},
+		exitCode: ExitPermissionDenied,
+		code:     "permission_denied",
+	},
+	{
+		errs:     []error{internal.ErrWaitTimeout, context.DeadlineExceeded},
+		exitCode: ExitTimeout,
+		code:     "timeout",
+	},
+	{
+		errs:     []error{ErrKeyNotFound, ErrMalformedKey},
+		exitCode: ExitKeyConfig,
+		code:     "key_config",
+	},
+	{
+		errs:     []error{internal.ErrUnexpectedStatus},
+		exitCode: ExitAPI,
+		code:     "api_error",
+	},
+}
+
+func lookupExitError(err error) *exitError {
+	for i := range exitErrors {
+		for _, target := range exitErrors[i].errs {
+			if errors.Is(err, target) {
+				return &exitErrors[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExitCode returns the exit code of opair for the error.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if e := lookupExitError(err); e != nil {
+		return e.exitCode
+	}
+
+	return ExitFailure
+}
+
+// ErrorCode returns the machine-readable code of the error, as found in the JSON logs and the run report.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if e := lookupExitError(err); e != nil {
+		return e.code
+	}
+
+	return "failure"
+}
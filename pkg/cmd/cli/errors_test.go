@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/internal"
+	"optable-pair-cli/pkg/pair"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err      error
+		exitCode int
+		code     string
+	}{
+		{nil, 0, ""},
+		{errors.New("boom"), ExitFailure, "failure"},
+		{fmt.Errorf("hashEncryt: %w", pair.ErrInputBelowThreshold), ExitInputBelowThreshold, "input_below_threshold"},
+		{fmt.Errorf("GetCleanroom: %w: %w: 401", internal.ErrUnauthorized, internal.ErrUnexpectedStatus), ExitInvalidToken, "invalid_token"},
+		{fmt.Errorf("failed to parse clean room token: %w", internal.ErrInvalidToken), ExitInvalidToken, "invalid_token"},
+		{fmt.Errorf("%w: invalid publisher state: REJECTED", ErrInvalidState), ExitInvalidState, "invalid_state"},
+		{fmt.Errorf("failed to wait for publisher: %w", internal.ErrTerminalState), ExitInvalidState, "invalid_state"},
+		{fmt.Errorf("b.Close: %w", bucket.ErrPermissionDenied), ExitPermissionDenied, "permission_denied"},
+		{fmt.Errorf("GetCleanroom: %w: %w: 403", internal.ErrForbidden, internal.ErrUnexpectedStatus), ExitPermissionDenied, "permission_denied"},
+		{fmt.Errorf("pairRW.ReEncrypt: %w", context.DeadlineExceeded), ExitTimeout, "timeout"},
+		{fmt.Errorf("%w after 1h0m0s", internal.ErrWaitTimeout), ExitTimeout, "timeout"},
+		{fmt.Errorf("ReadKeyConfig: %w", ErrMalformedKey), ExitKeyConfig, "key_config"},
+		{fmt.Errorf("GetCleanroom: %w: 500", internal.ErrUnexpectedStatus), ExitAPI, "api_error"},
+		{fmt.Errorf("matcher.Match: %w: gs://bucket/data.csv holds 10 rows", ErrTampered), ExitTampered, "tampered"},
+		{fmt.Errorf("%w: 3 of 20 checks failed", ErrVerificationFailed), ExitVerificationFailed, "verification_failed"},
+		{fmt.Errorf("%w by interrupt: pairRW.HashEncrypt: %w", ErrInterrupted, context.Canceled), ExitInterrupted, "interrupted"},
+	} {
+		require.Equal(t, tc.exitCode, ExitCode(tc.err), "%v", tc.err)
+		require.Equal(t, tc.code, ErrorCode(tc.err), "%v", tc.err)
+	}
+}
@@ -1,7 +1,6 @@
 package cli
 
 import (
-	"errors"
 	"fmt"
 	"optable-pair-cli/pkg/internal"
 	"time"
@@ -25,15 +24,16 @@ func (c *GetCmd) Run(cli *CmdContext) error {
 	ctx := cli.Context()
 
 	if c.PairCleanroomToken == "" {
-		return errors.New("pair clean room token is required")
+		return ErrTokenRequired
 	}
+	cli.redact(c.PairCleanroomToken)
 
 	cleanroomToken, err := internal.ParseCleanroomToken(c.PairCleanroomToken)
 	if err != nil {
 		return fmt.Errorf("failed to parse clean room token: %w", err)
 	}
 
-	client, err := internal.NewCleanroomClient(cleanroomToken)
+	client, err := internal.NewCleanroomClient(cleanroomToken, cli.clientOptions()...)
 	if err != nil {
 		return fmt.Errorf("failed to create clean room client: %w", err)
 	}
@@ -0,0 +1,261 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+type (
+	// integrityRecord records the digest of each publisher triple encrypted
+	// object written by step 2, by URL. It is stored locally, out of reach of
+	// the publisher, so that the match can detect whether the objects were
+	// altered in the bucket since, without keeping a copy of them.
+	integrityRecord struct {
+		path string
+		mu   sync.Mutex // guards Objects, recorded by the objects re-encrypted concurrently
+
+		Objects map[string]objectDigest `json:"objects"`
+	}
+
+	objectDigest struct {
+		Size   int64  `json:"size"`
+		Rows   int64  `json:"rows"`
+		CRC32C string `json:"crc32c"`
+		SHA256 string `json:"sha256"`
+		// StoredSize and StoredSHA256 describe the data as stored, which
+		// differs from the data when compressed. They are not recorded by
+		// earlier versions of opair.
+		StoredSize   int64  `json:"stored_size,omitempty"`
+		StoredSHA256 string `json:"stored_sha256,omitempty"`
+	}
+
+	// digester computes the digest of the data written to it.
+	digester struct {
+		sha  hash.Hash
+		crc  hash.Hash32
+		size int64
+		rows int64
+	}
+
+	// verifyingReader computes the digest of the object read through it and
+	// fails once read entirely if it differs from the recorded one.
+	verifyingReader struct {
+		io.Reader
+		url    string
+		digest *digester
+		want   objectDigest
+	}
+)
+
+// integrityRecordPath returns the path of the integrity record of the clean
+// room, stored next to the configuration file.
+func integrityRecordPath(configPath, cleanroomName string) string {
+	return filepath.Join(filepath.Dir(configPath), "integrity", path.Base(cleanroomName)+".json")
+}
+
+// loadIntegrityRecord reads the integrity record stored at path, or returns
+// an empty one if there is none.
+func loadIntegrityRecord(path string) (*integrityRecord, error) {
+	record := &integrityRecord{
+		path:    path,
+		Objects: make(map[string]objectDigest),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read integrity record: %w", err)
+	}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("failed to parse integrity record %s: %w", path, err)
+	}
+	if record.Objects == nil {
+		record.Objects = make(map[string]objectDigest)
+	}
+
+	return record, nil
+}
+
+// has returns whether the object is recorded.
+func (r *integrityRecord) has(url string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.Objects[url]
+	return ok
+}
+
+// add records the digest of the object and saves the record, so that it is
+// kept when the step is resumed.
+func (r *integrityRecord) add(url string, digest objectDigest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Objects[url] = digest
+	return r.save()
+}
+
+// retain drops the objects recorded by earlier runs which are not part of the
+// data anymore, and saves the record.
+func (r *integrityRecord) retain(urls []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for url := range r.Objects {
+		if !slices.Contains(urls, url) {
+			delete(r.Objects, url)
+		}
+	}
+
+	return r.save()
+}
+
+func (r *integrityRecord) save() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return fmt.Errorf("failed to create integrity record directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal integrity record: %w", err)
+	}
+
+	// the record is replaced at once, so that it is never left half written.
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write integrity record: %w", err)
+	}
+
+	return os.Rename(tmp, r.path)
+}
+
+// verify checks that the objects stored are the ones recorded, with the
+// recorded sizes, and CRC32C checksums when the storage provides them. The
+// CRC32C checksums of compressed objects are the ones of the compressed data,
+// which are not recorded, and so are their sizes by earlier versions of opair.
+// The data stored is verified by verifyStored.
+func (r *integrityRecord) verify(objects []bucket.Object) error {
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		want, ok := r.Objects[obj.URL]
+		if !ok {
+			return fmt.Errorf("%w: %s was not written by step 2", ErrTampered, obj.URL)
+		}
+
+		if want.StoredSHA256 != "" && obj.Size != want.StoredSize {
+			return fmt.Errorf("%w: %s holds %d bytes, %d bytes were written",
+				ErrTampered, obj.URL, obj.Size, want.StoredSize)
+		}
+
+		if !obj.Compressed && (obj.Size != want.Size || (obj.CRC32C != "" && obj.CRC32C != want.CRC32C)) {
+			return fmt.Errorf("%w: %s holds %d bytes with CRC32C %s, %d bytes with CRC32C %s were written",
+				ErrTampered, obj.URL, obj.Size, obj.CRC32C, want.Size, want.CRC32C)
+		}
+
+		seen[obj.URL] = true
+	}
+
+	for url := range r.Objects {
+		if !seen[url] {
+			return fmt.Errorf("%w: %s written by step 2 is missing", ErrTampered, url)
+		}
+	}
+
+	return nil
+}
+
+// verifyStored reads the data of the object as stored from r, and checks that
+// it is the data recorded. Objects recorded by earlier versions of opair have
+// no digest of their data as stored, and are only verified by reader.
+func (r *integrityRecord) verifyStored(url string, rd io.Reader) error {
+	want := r.Objects[url]
+	if want.StoredSHA256 == "" {
+		return nil
+	}
+
+	d := newDigester()
+	if _, err := io.Copy(d, rd); err != nil {
+		return fmt.Errorf("failed to read %s: %w", url, err)
+	}
+
+	if got := d.digest(); got.Size != want.StoredSize || got.SHA256 != want.StoredSHA256 {
+		return fmt.Errorf("%w: %s holds %d bytes with SHA256 %s, %d bytes with SHA256 %s were written",
+			ErrTampered, url, got.Size, got.SHA256, want.StoredSize, want.StoredSHA256)
+	}
+
+	return nil
+}
+
+// reader wraps the reader of the object so that reading it fails with
+// ErrTampered once read entirely if its content is not the recorded one.
+// It catches the objects altered since verifyStored, on the storages which
+// do not pin the version read.
+func (r *integrityRecord) reader(url string, rd io.Reader) io.Reader {
+	d := newDigester()
+	return &verifyingReader{
+		Reader: io.TeeReader(rd, d),
+		url:    url,
+		digest: d,
+		want:   r.Objects[url],
+	}
+}
+
+func newDigester() *digester {
+	return &digester{
+		sha: sha256.New(),
+		crc: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.sha.Write(p)
+	d.crc.Write(p)
+	d.size += int64(len(p))
+	d.rows += int64(bytes.Count(p, []byte{'\n'}))
+	return len(p), nil
+}
+
+func (d *digester) digest() objectDigest {
+	return objectDigest{
+		Size:   d.size,
+		Rows:   d.rows,
+		CRC32C: fmt.Sprintf("%08x", d.crc.Sum32()),
+		SHA256: hex.EncodeToString(d.sha.Sum(nil)),
+	}
+}
+
+// withStored returns the digest along with the size and hex SHA-256 checksum
+// of the data as stored.
+func (d objectDigest) withStored(size int64, sha256 string) objectDigest {
+	d.StoredSize = size
+	d.StoredSHA256 = sha256
+	return d
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if errors.Is(err, io.EOF) {
+		if got := r.digest.digest(); got.Size != r.want.Size || got.Rows != r.want.Rows ||
+			got.CRC32C != r.want.CRC32C || got.SHA256 != r.want.SHA256 {
+			return n, fmt.Errorf("%w: %s holds %d rows with SHA256 %s, %d rows with SHA256 %s were written",
+				ErrTampered, r.url, got.Rows, got.SHA256, r.want.Rows, r.want.SHA256)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"optable-pair-cli/pkg/bucket"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegrityRecord(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url     = "gs://bucket/publisher_triple_encrypted/data.csv"
+		content = "a\nb\nc\n"
+	)
+
+	path := filepath.Join(t.TempDir(), "integrity", "test.json")
+	record, err := loadIntegrityRecord(path)
+	require.NoError(t, err)
+	require.Empty(t, record.Objects, "must start empty without a record")
+
+	digest := newDigester()
+	_, err = io.WriteString(digest, content)
+	require.NoError(t, err)
+	require.NoError(t, record.add(url, digest.digest()))
+	require.NoError(t, record.add("gs://bucket/publisher_triple_encrypted/stale.csv", digest.digest()))
+	require.NoError(t, record.retain([]string{url}))
+
+	// the record is kept across runs.
+	record, err = loadIntegrityRecord(path)
+	require.NoError(t, err)
+	require.Len(t, record.Objects, 1)
+	require.Equal(t, int64(3), record.Objects[url].Rows)
+
+	stored := bucket.Object{URL: url, Size: int64(len(content)), CRC32C: fmt.Sprintf("%08x", crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))}
+	require.NoError(t, record.verify([]bucket.Object{stored}))
+	require.ErrorIs(t, record.verify(nil), ErrTampered, "must detect deleted objects")
+	require.ErrorIs(t, record.verify([]bucket.Object{stored, {URL: "gs://bucket/publisher_triple_encrypted/extra.csv"}}), ErrTampered, "must detect added objects")
+
+	resized := stored
+	resized.Size++
+	require.ErrorIs(t, record.verify([]bucket.Object{resized}), ErrTampered, "must detect resized objects")
+
+	// the storages which do not provide CRC32C checksums only have the size checked.
+	altered := stored
+	altered.CRC32C = "00000000"
+	require.ErrorIs(t, record.verify([]bucket.Object{altered}), ErrTampered, "must detect altered objects")
+	altered.CRC32C = ""
+	require.NoError(t, record.verify([]bucket.Object{altered}))
+
+	// the data as stored is verified before matching, when recorded.
+	require.NoError(t, record.verifyStored(url, strings.NewReader("altered")), "must skip objects recorded without stored digest")
+
+	stored.Compressed = true
+	digest = newDigester()
+	_, err = io.WriteString(digest, "compressed")
+	require.NoError(t, err)
+	compressed := digest.digest()
+	require.NoError(t, record.add(url, record.Objects[url].withStored(compressed.Size, compressed.SHA256)))
+
+	stored.Size = compressed.Size
+	require.NoError(t, record.verify([]bucket.Object{stored}))
+	stored.Size++
+	require.ErrorIs(t, record.verify([]bucket.Object{stored}), ErrTampered, "must detect resized compressed objects")
+
+	require.NoError(t, record.verifyStored(url, strings.NewReader("compressed")))
+	require.ErrorIs(t, record.verifyStored(url, strings.NewReader("comprossed")), ErrTampered, "must detect altered stored data")
+
+	// the content is verified once read entirely.
+	for data, expected := range map[string]error{
+		content:     nil,
+		"a\nc\nb\n": ErrTampered,
+		"a\nb\n":    ErrTampered,
+	} {
+		_, err := io.ReadAll(record.reader(url, strings.NewReader(data)))
+		if expected == nil {
+			require.NoError(t, err, data)
+		} else {
+			require.ErrorIs(t, err, expected, fmt.Sprintf("%q", data))
+		}
+	}
+}
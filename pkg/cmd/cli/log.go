@@ -1,10 +1,56 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"os"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// logFormatJSON writes the log lines as JSON objects instead of human readable lines.
+	logFormatJSON = "json"
+
+	// minSecretLength is the minimum length of a secret to redact, to avoid redacting common short strings.
+	minSecretLength = 8
+)
+
+var (
+	redacted = []byte("[REDACTED]")
+
+	// secretPatterns match secrets that are not known beforehand: JWTs, such as
+	// the clean room tokens, and Google OAuth2 access tokens, such as the down
+	// scoped GCS tokens.
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		regexp.MustCompile(`ya29\.[A-Za-z0-9_.-]+`),
+	}
+)
+
+type (
+	// LogFlags configures the format and the destination of the logs.
+	LogFlags struct {
+		Format     string `default:"console" enum:"console,json" help:"The format of the log lines: human readable (console) or one JSON object per line (json)."`
+		File       string `type:"path" help:"The path of a file to write the logs to, in addition to stderr. The file is rotated when it reaches --log-max-size."`
+		MaxSize    int    `default:"100" help:"The maximum size in megabytes of the log file before it is rotated."`
+		MaxBackups int    `default:"5" help:"The maximum number of rotated log files to keep."`
+		MaxAge     int    `default:"0" help:"The maximum number of days to keep rotated log files. 0 keeps them regardless of their age."`
+	}
+
+	// redactingWriter replaces the secrets in the log lines before writing them
+	// to the underlying writer. zerolog writes each event with a single call to
+	// Write, so a secret is never split across two calls.
+	redactingWriter struct {
+		w       io.Writer
+		lock    sync.RWMutex
+		secrets [][]byte
+	}
 )
 
 // LevelFromVerbosity takes a command-line `-v` stackable flag count, e.g.
@@ -25,10 +71,94 @@ func LevelFromVerbosity(v int) zerolog.Level {
 }
 
 func NewLogger(cliName string, verbosity int) *zerolog.Logger {
-	logger := zerolog.
-		New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).
+	logger := newLogger(cliName, verbosity, zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	return &logger
+}
+
+func newLogger(cliName string, verbosity int, w io.Writer) zerolog.Logger {
+	return zerolog.
+		New(w).
 		Level(LevelFromVerbosity(verbosity)).With().Timestamp().
 		Str("cli", cliName).
 		Logger()
-	return &logger
+}
+
+// writer returns the writer of the log lines, as configured by the flags, and
+// a function closing the log file, if any.
+func (f LogFlags) writer() (io.Writer, func()) {
+	var (
+		writers []io.Writer
+		closer  = func() {}
+	)
+
+	if f.Format == logFormatJSON {
+		writers = append(writers, os.Stderr)
+	} else {
+		writers = append(writers, zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	}
+
+	if f.File != "" {
+		file := &lumberjack.Logger{
+			Filename:   f.File,
+			MaxSize:    f.MaxSize,
+			MaxBackups: f.MaxBackups,
+			MaxAge:     f.MaxAge,
+		}
+		closer = func() { _ = file.Close() }
+
+		if f.Format == logFormatJSON {
+			writers = append(writers, file)
+		} else {
+			writers = append(writers, zerolog.ConsoleWriter{Out: file, TimeFormat: time.RFC3339, NoColor: true})
+		}
+	}
+
+	if len(writers) == 1 {
+		return writers[0], closer
+	}
+
+	return zerolog.MultiLevelWriter(writers...), closer
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+// add registers secrets to redact from the subsequent log lines.
+func (r *redactingWriter) add(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			r.secrets = append(r.secrets, []byte(secret))
+		}
+	}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	line := p
+
+	r.lock.RLock()
+	for _, secret := range r.secrets {
+		line = bytes.ReplaceAll(line, secret, redacted)
+	}
+	r.lock.RUnlock()
+
+	for _, pattern := range secretPatterns {
+		line = pattern.ReplaceAll(line, redacted)
+	}
+
+	if _, err := r.w.Write(line); err != nil {
+		return 0, err
+	}
+
+	// report the length of the original line, as expected by the caller.
+	return len(p), nil
+}
+
+// withLogField returns a context whose logger adds the given field to every event.
+func withLogField(ctx context.Context, key, value string) context.Context {
+	logger := zerolog.Ctx(ctx).With().Str(key, value).Logger()
+	return logger.WithContext(ctx)
 }
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/internal"
+	"os"
+	"time"
+)
+
+type (
+	ManifestCmd struct {
+		Show ManifestShowCmd `cmd:"" help:"Show the manifests of the PAIR data uploaded to the specified Optable PAIR clean room."`
+	}
+
+	ManifestShowCmd struct {
+		PairCleanroomToken string `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+	}
+)
+
+func (c *ManifestShowCmd) Run(cli *CmdContext) error {
+	ctx := cli.Context()
+
+	if c.PairCleanroomToken == "" {
+		return ErrTokenRequired
+	}
+	cli.redact(c.PairCleanroomToken)
+
+	pairCfg, paths, err := pairDataPaths(ctx, cli, c.PairCleanroomToken)
+	if err != nil {
+		return err
+	}
+
+	return writeManifests(ctx, os.Stdout, pairCfg, paths)
+}
+
+// dataPath is a PAIR data path of the clean room, and its description.
+type dataPath struct {
+	name string
+	url  string
+}
+
+// pairDataPaths returns the configuration the storage of the clean room is
+// accessed with, and the paths of its four PAIR datasets.
+func pairDataPaths(ctx context.Context, cli *CmdContext, token string) (*pairConfig, []dataPath, error) {
+	cleanroomToken, err := internal.ParseCleanroomToken(token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse clean room token: %w", err)
+	}
+
+	client, err := internal.NewCleanroomClient(cleanroomToken, cli.clientOptions()...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create clean room client: %w", err)
+	}
+
+	gcsToken, err := client.GetDownScopedToken(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get down scoped token: %w", err)
+	}
+	cli.redact(gcsToken)
+
+	clrConfig, err := client.GetConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pairCfg := &pairConfig{
+		downscopedToken: gcsToken,
+		storageOptions:  cli.storageOptions(),
+	}
+
+	return pairCfg, []dataPath{
+		{advertiserTwice, clrConfig.GetAdvertiserTwiceEncryptedDataUrl()},
+		{publisherTwice, clrConfig.GetPublisherTwiceEncryptedDataUrl()},
+		{advertiserTriple, clrConfig.GetAdvertiserTripleEncryptedDataUrl()},
+		{publisherTriple, clrConfig.GetPublisherTripleEncryptedDataUrl()},
+	}, nil
+}
+
+// The descriptions of the PAIR data paths.
+const (
+	advertiserTwice  = "advertiser twice encrypted"
+	publisherTwice   = "publisher twice encrypted"
+	advertiserTriple = "advertiser triple encrypted"
+	publisherTriple  = "publisher triple encrypted"
+)
+
+// writeManifests prints the manifest of each of the paths, or that there is
+// none when the data was not uploaded yet or by a version of opair which does
+// not write manifests.
+func writeManifests(ctx context.Context, w io.Writer, pairCfg *pairConfig, paths []dataPath) error {
+	client, err := pairCfg.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	p := &planWriter{w: w}
+	for i, path := range paths {
+		if i > 0 {
+			p.printf("")
+		}
+		p.printf("%s: %s", path.name, path.url)
+
+		manifest, err := bucket.ReadManifest(ctx, client, path.url)
+		if errors.Is(err, bucket.ErrNoManifest) {
+			p.printf("  no manifest")
+			continue
+		} else if err != nil {
+			return fmt.Errorf("bucket.ReadManifest: %w", err)
+		}
+
+		var rows, size int64
+		for _, obj := range manifest.Objects {
+			rows += obj.Rows
+			size += obj.Size
+		}
+
+		p.printf("  step:            %s", manifest.Step)
+		p.printf("  opair version:   %s", manifest.OpairVersion)
+		p.printf("  key fingerprint: %s", manifest.KeyFingerprint)
+		p.printf("  created at:      %s", manifest.CreatedAt.Format(time.RFC3339))
+		p.printf("  objects:         %d, %d rows, %d bytes", len(manifest.Objects), rows, size)
+		for _, obj := range manifest.Objects {
+			p.printf("    %s: %d rows, %d bytes, crc32c %s, md5 %s", obj.URL, obj.Rows, obj.Size, obj.CRC32C, obj.MD5)
+		}
+	}
+
+	return p.err
+}
@@ -9,14 +9,33 @@ import (
 	"optable-pair-cli/pkg/io"
 	"optable-pair-cli/pkg/keys"
 	"optable-pair-cli/pkg/pair"
+	"optable-pair-cli/pkg/progress"
+	"optable-pair-cli/pkg/tracing"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
 type pairConfig struct {
+	cleanroomName   string
+	keyID           string
+	report          *runReport
+	progress        progress.Mode
+	stepTimeout     time.Duration
 	downscopedToken string
 	threads         int
+	shardRows       int64
+	shardSize       int64
+	// compression is the compression of the objects written, one of
+	// compressionGzip or compressionNone. None when empty.
+	compression     string
 	salt            string
 	key             string
 	cleanroomClient *internal.CleanroomClient
@@ -24,11 +43,16 @@ type pairConfig struct {
 	advTriplePath   string
 	pubTwicePath    string
 	pubTriplePath   string
+	// integrityPath is the path of the local integrity record of the
+	// publisher triple encrypted data. No record is kept when empty.
+	integrityPath string
+	// storageOptions configure the storage client of each step.
+	storageOptions []bucket.ClientOption
 }
 
-func newPAIRConfig(ctx context.Context, token string, threads int, key string) (*pairConfig, error) {
+func newPAIRConfig(ctx context.Context, token string, threads int, key string, opts ...internal.ClientOption) (*pairConfig, error) {
 	if token == "" {
-		return nil, errors.New("pair clean room token is required")
+		return nil, ErrTokenRequired
 	}
 
 	cleanroomToken, err := internal.ParseCleanroomToken(token)
@@ -41,7 +65,7 @@ func newPAIRConfig(ctx context.Context, token string, threads int, key string) (
 		return nil, fmt.Errorf("failed to create PAIR private key: %w", err)
 	}
 
-	client, err := internal.NewCleanroomClient(cleanroomToken)
+	client, err := internal.NewCleanroomClient(cleanroomToken, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create clean room client: %w", err)
 	}
@@ -57,6 +81,7 @@ func newPAIRConfig(ctx context.Context, token string, threads int, key string) (
 	}
 
 	return &pairConfig{
+		cleanroomName:   cleanroomToken.Cleanroom,
 		downscopedToken: gcsToken,
 		threads:         threads,
 		salt:            cleanroomToken.HashSalt,
@@ -69,18 +94,137 @@ func newPAIRConfig(ctx context.Context, token string, threads int, key string) (
 	}, nil
 }
 
+// newPAIRConfigFromCLI reads the advertiser key of the command context and
+// instantiates the PAIR configuration for the given clean room token.
+func newPAIRConfigFromCLI(cli *CmdContext, token string, threads int) (*pairConfig, error) {
+	// the commands running the PAIR steps can be resumed once interrupted.
+	cli.resumable = true
+	cli.cleanroomToken = token
+
+	keyConfig, err := readKeyConfig(cli.keyContext, cli.config)
+	if err != nil {
+		return nil, fmt.Errorf("ReadKeyConfig: %w", err)
+	}
+
+	if threads <= 0 {
+		threads = defaultThreadCount
+	}
+
+	cli.redact(token, keyConfig.Key)
+
+	pairCfg, err := newPAIRConfig(cli.Context(), token, threads, keyConfig.Key, cli.clientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	cli.redact(pairCfg.downscopedToken)
+
+	pairCfg.keyID = keyConfig.ID
+	pairCfg.progress = cli.progress
+	pairCfg.stepTimeout = cli.stepTimeout
+	pairCfg.storageOptions = cli.storageOptions()
+	pairCfg.integrityPath = integrityRecordPath(cli.config.configPath, pairCfg.cleanroomName)
+
+	// every subsequent log event of the command carries the clean room and the key.
+	zerolog.Ctx(cli.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("cleanroom", pairCfg.cleanroomName).Str("key_id", pairCfg.keyID)
+	})
+
+	return pairCfg, nil
+}
+
+// stepContext returns the context of a step of the PAIR protocol, which is done
+// once the duration set by the `--step-timeout` flag is exceeded.
+func (c *pairConfig) stepContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.stepTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, c.stepTimeout, fmt.Errorf("--step-timeout of %s exceeded: %w", c.stepTimeout, context.DeadlineExceeded))
+}
+
+// stepError names the step in the error of a step interrupted by a deadline,
+// either the one of the step or the one of the command.
+func stepError(step string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out: %w", step, err)
+	}
+
+	return err
+}
+
+// participantStates fetches the clean room and returns the state of the publisher and the advertiser.
+func (c *pairConfig) participantStates(ctx context.Context) (publisherState, advertiserState v1.Cleanroom_Participant_State, err error) {
+	cleanroom, err := c.cleanroomClient.GetCleanroom(ctx, false)
+	if err != nil {
+		return publisherState, advertiserState, fmt.Errorf("GetCleanroom: %w", err)
+	}
+
+	return participantStates(cleanroom)
+}
+
+// inputSource returns the source recorded in the metadata of the objects
+// written from the input of step 1: the absolute path of the input files, or
+// stdin.
+func inputSource(input string) string {
+	if input == "" {
+		return "stdin"
+	}
+
+	if path, err := filepath.Abs(input); err == nil {
+		return "file://" + filepath.ToSlash(path)
+	}
+
+	return input
+}
+
 func (c *pairConfig) hashEncryt(ctx context.Context, input string) (err error) {
+	defer func() { err = stepError(stepOneName, err) }()
+
+	ctx, cancel := c.stepContext(ctx)
+	defer cancel()
+
+	ctx = withLogField(ctx, "step", stepOne)
 	logger := zerolog.Ctx(ctx)
 	logger.Info().Msg("Step 1: Hash and encrypt the advertiser data.")
 
+	ctx, span := tracing.Start(ctx, stepOne, attribute.String("cleanroom", c.cleanroomName))
+	defer func() { tracing.End(span, err) }()
+
+	stepReport := c.report.start(stepOne)
+	defer stepReport.finish()
+
 	fs, err := io.FileReaders(input)
 	if err != nil {
 		return fmt.Errorf("io.FileReaders: %w", err)
 	}
-	in := io.MultiReader(fs...)
+
+	// large files are split so that they are parsed concurrently.
+	fs, err = io.Split(fs, c.threads)
+	if err != nil {
+		return fmt.Errorf("io.Split: %w", err)
+	}
+
+	size, err := io.Size(input)
+	if err != nil {
+		return fmt.Errorf("io.Size: %w", err)
+	}
+
+	counter := &io.Counter{}
+	in := make([]io.Reader, len(fs))
+	for i, f := range fs {
+		in[i] = counter.Reader(f)
+	}
+
+	// the buckets of the step are shared, and closed once done with.
+	storageClient, err := c.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
 
 	// defer statements are executed in Last In First Out order, so we will write the completed file last.
-	bucketCompleter, err := bucket.NewBucketCompleter(ctx, c.downscopedToken, c.advTwicePath)
+	bucketCompleter, err := bucket.NewBucketCompleter(ctx, storageClient, c.advTwicePath)
 	if err != nil {
 		return fmt.Errorf("bucket.NewBucketCompleter: %w", err)
 	}
@@ -90,12 +234,13 @@ func (c *pairConfig) hashEncryt(ctx context.Context, input string) (err error) {
 	}
 	if hasCompleted {
 		// nothing to do if the advertiser data has pushed the data
+		stepReport.skipped(reasonUploaded)
 		return nil
 	}
 
 	defer func() {
-		// don't complete the bucket if there was an error to prevent writing
-		// unwanted files.
+		// don't complete the bucket if there was an error, e.g. when
+		// interrupted, to prevent writing unwanted files.
 		if err != nil {
 			return
 		}
@@ -106,20 +251,28 @@ func (c *pairConfig) hashEncryt(ctx context.Context, input string) (err error) {
 		}
 	}()
 
-	b, err := bucket.NewBucketReadWriter(ctx, c.downscopedToken, c.advTwicePath, bucket.WithReader(in))
+	b, err := bucket.NewBucketReadWriter(ctx, storageClient, c.advTwicePath,
+		bucket.WithReaders(in...),
+		bucket.WithReadersSource(inputSource(input)),
+		bucket.WithShardRows(c.shardRows),
+		bucket.WithShardSize(c.shardSize),
+		bucket.WithShardUploads(c.threads),
+		bucket.WithCompression(c.compress()),
+	)
 	if err != nil {
 		return fmt.Errorf("bucket.NewBucket: %w", err)
 	}
 	defer func() {
-		// don't close the bucket if there was an error to prevent writing
-		// unwanted files.
+		// abort the uploads if there was an error, e.g. when interrupted, to
+		// prevent committing partial objects. The destination is left untouched.
 		if err != nil {
+			b.Abort()
 			return
 		}
 
-		if err := b.Close(); err != nil {
-			logger.Error().Err(err).Msg("failed to close bucket")
-			return
+		// the objects are promoted by then, don't complete the bucket otherwise.
+		if closeErr := b.Close(); closeErr != nil {
+			err = fmt.Errorf("b.Close: %w", closeErr)
 		}
 	}()
 
@@ -127,26 +280,67 @@ func (c *pairConfig) hashEncryt(ctx context.Context, input string) (err error) {
 		return errors.New("failed to create NewBucket: invalid number of read writers")
 	}
 
-	pairRW, err := pair.NewPAIRIDReadWriter(b.FileReader, b.ReadWriters[0].Writer)
+	// the numbered objects are uploaded concurrently, each written by its own writer.
+	writers := b.ReadWriters[0].Writers()
+	pairRW, err := pair.NewPAIRIDReadWriter(b.FileReaders, writers[0], pair.WithConcurrentWriters(writers[1:]...))
 	if err != nil {
 		return fmt.Errorf("pair.NewPAIRIDReadWriter: %w", err)
 	}
 
-	if err := pairRW.HashEncrypt(ctx, c.threads, c.salt, c.key); err != nil {
+	stepReport.ReadObjects = []string{input}
+	// the objects are known once written, when uploading numbered objects.
+	defer func() { stepReport.WrittenObjects = b.ReadWriters[0].DestinationURLs() }()
+	defer stepReport.addRows(pairRW)
+
+	reporter := progress.Start(ctx, c.progress, stepOneName, size, func() (uint64, int64) {
+		return pairRW.RowsRead(), counter.Count()
+	})
+
+	err = pairRW.HashEncrypt(ctx, c.threads, c.salt, c.key)
+	reporter.Stop()
+	if err != nil {
 		return fmt.Errorf("pairRW.HashEncrypt: %w", err)
 	}
 
+	// the objects are staged until all of them are written and verified.
+	if err := b.Promote(ctx); err != nil {
+		return fmt.Errorf("b.Promote: %w", err)
+	}
+
+	if err := c.writeManifest(ctx, stepOne, b, bucketCompleter); err != nil {
+		return fmt.Errorf("c.writeManifest: %w", err)
+	}
+
 	logger.Info().Msg("Step 1: Hash and encrypt the advertiser data completed.")
 
 	return
 }
 
 func (c *pairConfig) reEncrypt(ctx context.Context, publisherPAIRIDsPath string) (err error) {
+	defer func() { err = stepError(stepTwoName, err) }()
+
+	ctx, cancel := c.stepContext(ctx)
+	defer cancel()
+
+	ctx = withLogField(ctx, "step", stepTwo)
 	logger := zerolog.Ctx(ctx)
 	logger.Info().Msg("Step 2: Re-encrypt the publisher's hashed and encrypted PAIR IDs.")
 
+	ctx, span := tracing.Start(ctx, stepTwo, attribute.String("cleanroom", c.cleanroomName))
+	defer func() { tracing.End(span, err) }()
+
+	stepReport := c.report.start(stepTwo)
+	defer stepReport.finish()
+
+	// the buckets of the step are shared, and closed once done with.
+	storageClient, err := c.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+
 	// defer statements are executed in Last In First Out order, so we will write the completed file last.
-	bucketCompleter, err := bucket.NewBucketCompleter(ctx, c.downscopedToken, c.pubTriplePath)
+	bucketCompleter, err := bucket.NewBucketCompleter(ctx, storageClient, c.pubTriplePath)
 	if err != nil {
 		return fmt.Errorf("bucket.NewBucketCompleter: %w", err)
 	}
@@ -157,11 +351,12 @@ func (c *pairConfig) reEncrypt(ctx context.Context, publisherPAIRIDsPath string)
 	}
 	if hasCompleted {
 		// nothing to do if the advertiser data has pushed the data
+		stepReport.skipped(reasonUploaded)
 		return nil
 	}
 	defer func() {
-		// don't complete the bucket if there was an error to prevent writing
-		// unwanted files.
+		// don't complete the bucket if there was an error, e.g. when
+		// interrupted, to prevent writing unwanted files.
 		if err != nil {
 			return
 		}
@@ -172,23 +367,35 @@ func (c *pairConfig) reEncrypt(ctx context.Context, publisherPAIRIDsPath string)
 		}
 	}()
 
-	b, err := bucket.NewBucketReadWriter(ctx, c.downscopedToken, c.pubTriplePath, bucket.WithSourceURL(c.pubTwicePath))
+	b, err := bucket.NewBucketReadWriter(ctx, storageClient, c.pubTriplePath,
+		bucket.WithSourceURL(c.pubTwicePath),
+		bucket.WithCompression(c.compress()),
+	)
 	if err != nil {
 		return fmt.Errorf("bucket.NewBucket: %w", err)
 	}
 	defer func() {
-		// don't close the bucket if there was an error to prevent writing
-		// unwanted files.
+		// abort the uploads if there was an error, e.g. when interrupted, to
+		// prevent committing partial objects. The destination is left untouched.
 		if err != nil {
+			b.Abort()
 			return
 		}
 
-		if err := b.Close(); err != nil {
-			logger.Error().Err(err).Msg("failed to close bucket")
-			return
+		// the objects are promoted by then, don't complete the bucket otherwise.
+		if closeErr := b.Close(); closeErr != nil {
+			err = fmt.Errorf("b.Close: %w", closeErr)
 		}
 	}()
 
+	// the digest of each object is recorded locally to verify them before matching.
+	var record *integrityRecord
+	if c.integrityPath != "" {
+		if record, err = loadIntegrityRecord(c.integrityPath); err != nil {
+			return fmt.Errorf("loadIntegrityRecord: %w", err)
+		}
+	}
+
 	if publisherPAIRIDsPath != "" {
 		// create the publisher data directory if it does not exist
 		if err := os.MkdirAll(publisherPAIRIDsPath, os.ModePerm); err != nil {
@@ -196,33 +403,263 @@ func (c *pairConfig) reEncrypt(ctx context.Context, publisherPAIRIDsPath string)
 		}
 	}
 
+	// progress is reported across all objects, summing the rows of the objects
+	// re-encrypted so far. The objects completed by a previous run are skipped.
+	var (
+		size    int64
+		pending int
+		counter = &io.Counter{}
+		pairRWs = make([]atomic.Pointer[pair.IDReadWriter], len(b.ReadWriters))
+	)
+	unknownSize := false
+	for _, rw := range b.ReadWriters {
+		if !rw.Completed() {
+			size += rw.Size()
+			unknownSize = unknownSize || rw.Size() == 0
+			pending++
+		}
+	}
+	if unknownSize {
+		// the size of compressed objects once decompressed is unknown.
+		size = 0
+	}
+	if skipped := len(b.ReadWriters) - pending; skipped > 0 {
+		logger.Info().Msgf("%d of %d objects already re-encrypted by a previous run, skipping them", skipped, len(b.ReadWriters))
+	}
+
+	reporter := progress.Start(ctx, c.progress, stepTwoName, size, func() (uint64, int64) {
+		var rows uint64
+		for i := range pairRWs {
+			if pairRW := pairRWs[i].Load(); pairRW != nil {
+				rows += pairRW.RowsRead()
+			}
+		}
+		return rows, counter.Count()
+	})
+	defer reporter.Stop()
+
+	// the objects are re-encrypted concurrently, sharing the threads.
+	parallel, workers := splitThreads(c.threads, pending)
+	logger.Debug().Msgf("re-encrypting %d objects, %d at a time with %d workers each", pending, parallel, workers)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		failed atomic.Bool
+		sem    = make(chan struct{}, parallel)
+	)
 	for i, rw := range b.ReadWriters {
-		opt := []pair.ReadWriterOption{}
-		if publisherPAIRIDsPath != "" {
-			w, err := io.FileWriter(fmt.Sprintf("%s/pair_ids_%d.csv", publisherPAIRIDsPath, i))
-			if err != nil {
-				return fmt.Errorf("io.FileWriter: %w", err)
+		// stop starting objects once one failed, or once interrupted.
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if failed.Load() || ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := c.reEncryptObject(ctx, i, rw, workers, publisherPAIRIDsPath, record, counter, &pairRWs[i]); err != nil {
+				failed.Store(true)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", rw.SourceURL(), err))
+				mu.Unlock()
 			}
+		}()
+	}
+	wg.Wait()
 
-			opt = append(opt, pair.WithSecondaryWriter(w))
+	for i, rw := range b.ReadWriters {
+		if pairRW := pairRWs[i].Load(); pairRW != nil {
+			stepReport.ReadObjects = append(stepReport.ReadObjects, rw.SourceURL())
+			stepReport.WrittenObjects = append(stepReport.WrittenObjects, rw.DestinationURL())
+			stepReport.addRows(pairRW)
 		}
+	}
 
-		pairRW, err := pair.NewPAIRIDReadWriter(rw.Reader, rw.Writer, opt...)
-		if err != nil {
-			return fmt.Errorf("pair.NewPAIRIDReadWriter: %w", err)
+	if len(errs) > 0 {
+		// when interrupted, all the objects in progress fail for the same reason.
+		if ctx.Err() != nil {
+			return errs[0]
 		}
+		return errors.Join(errs...)
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	// the objects are staged until all of them are written and verified.
+	if err := b.Promote(ctx); err != nil {
+		return fmt.Errorf("b.Promote: %w", err)
+	}
+
+	if err := c.writeManifest(ctx, stepTwo, b, bucketCompleter); err != nil {
+		return fmt.Errorf("c.writeManifest: %w", err)
+	}
 
-		if err := pairRW.ReEncrypt(ctx, c.threads, c.salt, c.key); err != nil {
-			return fmt.Errorf("pairRW.ReEncrypt: %w", err)
+	if record != nil {
+		urls := make([]string, len(b.ReadWriters))
+		for i, rw := range b.ReadWriters {
+			urls[i] = rw.DestinationURL()
+		}
+		if err := record.retain(urls); err != nil {
+			return fmt.Errorf("record.retain: %w", err)
 		}
 	}
 
+	reporter.Stop()
+
 	logger.Info().Msg("Step 2: Re-encrypt the publisher's hashed and encrypted PAIR IDs completed.")
 
 	return
 }
 
-func (c *pairConfig) match(ctx context.Context, outputPath string, publisherPAIRIDsPath string) error {
+// compress returns whether the objects written by the steps are gzip-compressed.
+// The clean room config does not tell whether it expects compressed data, so
+// they are only compressed when asked to: the objects read are decompressed
+// regardless, each on its own.
+func (c *pairConfig) compress() bool {
+	return c.compression == compressionGzip
+}
+
+// newStorageClient creates the client the buckets of a step are accessed with.
+func (c *pairConfig) newStorageClient() (*bucket.Client, error) {
+	client, err := bucket.NewClient(c.downscopedToken, c.storageOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("bucket.NewClient: %w", err)
+	}
+
+	return client, nil
+}
+
+// writeManifest writes the manifest of the objects promoted by the step,
+// before the .Completed file is written.
+func (c *pairConfig) writeManifest(ctx context.Context, step string, b *bucket.ReadWriter, completer *bucket.Completer) error {
+	manifest, err := b.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("b.Manifest: %w", err)
+	}
+
+	fingerprint, err := keys.Fingerprint(c.key)
+	if err != nil {
+		return fmt.Errorf("keys.Fingerprint: %w", err)
+	}
+
+	manifest.Step = step
+	manifest.OpairVersion = version
+	manifest.KeyFingerprint = fingerprint
+	manifest.CreatedAt = time.Now().UTC()
+
+	return completer.WriteManifest(ctx, manifest)
+}
+
+// reEncryptObject re-encrypts the i-th object of step 2 with the given number
+// of workers, storing its IDReadWriter in current for progress reporting, and
+// commits it. The PAIR IDs are also written to publisherPAIRIDsPath when set,
+// copied from the object when it was completed by a previous run. The digest
+// of the object is added to the record, when set.
+func (c *pairConfig) reEncryptObject(ctx context.Context, i int, rw *bucket.ReadWriteCloser, workers int, publisherPAIRIDsPath string, record *integrityRecord, counter *io.Counter, current *atomic.Pointer[pair.IDReadWriter]) error {
+	var local io.Writer
+	if publisherPAIRIDsPath != "" {
+		w, err := io.FileWriter(fmt.Sprintf("%s/pair_ids_%d.csv", publisherPAIRIDsPath, i))
+		if err != nil {
+			return fmt.Errorf("io.FileWriter: %w", err)
+		}
+		// the local copy is closed once the object is done, even when interrupted.
+		if f, ok := w.(io.WriteCloser); ok {
+			defer f.Close()
+		}
+
+		local = w
+	}
+
+	digest := newDigester()
+	if rw.Completed() {
+		// the object was re-encrypted by a previous run, which recorded it
+		// unless it was run by an earlier version of opair.
+		unrecorded := record != nil && !record.has(rw.DestinationURL())
+		if local == nil && !unrecorded {
+			return nil
+		}
+
+		stored := newDigester()
+		r, err := rw.NewDestinationReader(ctx, stored)
+		if err != nil {
+			return fmt.Errorf("rw.NewDestinationReader: %w", err)
+		}
+		defer r.Close()
+
+		var w io.Writer = digest
+		if local != nil {
+			w = io.MultiWriter(local, digest)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("io.Copy: %w", err)
+		}
+
+		if unrecorded {
+			s := stored.digest()
+			return record.add(rw.DestinationURL(), digest.digest().withStored(s.Size, s.SHA256))
+		}
+		return nil
+	}
+
+	opt := []pair.ReadWriterOption{}
+	if local != nil {
+		opt = append(opt, pair.WithSecondaryWriter(local))
+	}
+
+	pairRW, err := pair.NewPAIRIDReadWriter([]io.Reader{counter.Reader(rw.Reader)}, io.MultiWriter(rw.Writer, digest), opt...)
+	if err != nil {
+		return fmt.Errorf("pair.NewPAIRIDReadWriter: %w", err)
+	}
+	current.Store(pairRW)
+
+	if err := pairRW.ReEncrypt(ctx, workers, c.salt, c.key); err != nil {
+		return fmt.Errorf("pairRW.ReEncrypt: %w", err)
+	}
+
+	// the object is committed on its own, so that it is not re-encrypted again
+	// if another object fails.
+	if err := rw.Commit(); err != nil {
+		return fmt.Errorf("rw.Commit: %w", err)
+	}
+
+	if record != nil {
+		size, sha256, _ := rw.StoredChecksum()
+		if err := record.add(rw.DestinationURL(), digest.digest().withStored(size, sha256)); err != nil {
+			return fmt.Errorf("record.add: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// splitThreads splits the threads among objects processed concurrently,
+// returning how many objects to process at a time and the number of workers
+// of each, so that there are no more workers than threads overall.
+func splitThreads(threads, objects int) (parallel, workers int) {
+	threads = max(threads, 1)
+	parallel = max(min(threads, objects), 1)
+	return parallel, threads / parallel
+}
+
+func (c *pairConfig) match(ctx context.Context, outputPath string, publisherPAIRIDsPath string) (err error) {
+	defer func() { err = stepError(stepThreeName, err) }()
+
+	// the step includes the wait for the publisher.
+	ctx, cancel := c.stepContext(ctx)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, stepThree, attribute.String("cleanroom", c.cleanroomName))
+	defer func() { tracing.End(span, err) }()
+
+	ctx = withLogField(ctx, "step", stepThree)
 	logger := zerolog.Ctx(ctx)
 	logger.Info().Msg("waiting for publisher to re-encrypt advertiser data")
 
@@ -232,12 +669,16 @@ func (c *pairConfig) match(ctx context.Context, outputPath string, publisherPAIR
 
 	logger.Info().Msg("Step 3: Match the two sets of triple encrypted PAIR IDs.")
 
+	stepReport := c.report.start(stepThree)
+	defer stepReport.finish()
+
 	if outputPath != "" {
 		if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
 			return fmt.Errorf("os.MkdirAll: %w", err)
 		}
 	}
 
+	var pubSize int64
 	opts := []bucket.Option{}
 	if publisherPAIRIDsPath != "" {
 		fs, err := io.FileReaders(publisherPAIRIDsPath)
@@ -245,31 +686,136 @@ func (c *pairConfig) match(ctx context.Context, outputPath string, publisherPAIR
 			return fmt.Errorf("io.FileReaders: %w", err)
 		}
 
-		opts = append(opts, bucket.WithReader(io.MultiReader(fs...)))
+		if fs, err = io.Split(fs, c.threads); err != nil {
+			return fmt.Errorf("io.Split: %w", err)
+		}
+
+		if pubSize, err = io.Size(publisherPAIRIDsPath); err != nil {
+			return fmt.Errorf("io.Size: %w", err)
+		}
+
+		opts = append(opts, bucket.WithReaders(fs...))
 	} else {
 		opts = append(opts, bucket.WithSourceURL(c.pubTriplePath))
 	}
 
-	b, err := bucket.NewReaders(ctx, c.downscopedToken, c.advTriplePath, opts...)
+	storageClient, err := c.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+
+	b, err := bucket.NewReaders(ctx, storageClient, c.advTriplePath, opts...)
 	if err != nil {
 		return fmt.Errorf("bucket.NewBucket: %w", err)
 	}
 	defer b.Close()
 
-	matcher, err := pair.NewMatcher(readersFromReadClosers(b.AdvReader), readersFromReadClosers(b.PubReader), outputPath)
+	pubReaders := readersFromReadClosers(b.PubReader)
+	if publisherPAIRIDsPath == "" {
+		pubSize = b.PubSize
+
+		// without a local copy, the data stored is verified against the
+		// record of step 2 before matching.
+		if err := c.verifyPublisherData(ctx, b, pubReaders); err != nil {
+			return err
+		}
+	}
+
+	// only the publisher data is read while matching, the advertiser data is
+	// loaded in memory beforehand.
+	counter := &io.Counter{}
+	for i, r := range pubReaders {
+		pubReaders[i] = counter.Reader(r)
+	}
+
+	matcher, err := pair.NewMatcher(readersFromReadClosers(b.AdvReader), pubReaders, outputPath)
 	if err != nil {
 		return fmt.Errorf("pair.NewMatcher: %w", err)
 	}
 
-	if err := matcher.Match(ctx, c.threads, c.salt, c.key); err != nil {
+	stepReport.ReadObjects = b.ObjectURLs
+	if publisherPAIRIDsPath != "" {
+		stepReport.ReadObjects = append(stepReport.ReadObjects, publisherPAIRIDsPath)
+	}
+	stepReport.WrittenObjects = []string{outputPath}
+
+	reporter := progress.Start(ctx, c.progress, stepThreeName, pubSize, func() (uint64, int64) {
+		return matcher.PublisherRowsRead(), counter.Count()
+	})
+
+	err = matcher.Match(ctx, c.threads, c.salt, c.key)
+	reporter.Stop()
+	stepReport.Read = matcher.AdvertiserRowsRead() + matcher.PublisherRowsRead()
+	stepReport.Written = matcher.Matched()
+	if errors.Is(err, ErrTampered) {
+		// the results are built from tampered data, they must not be used.
+		if rmErr := matcher.RemoveResults(); rmErr != nil {
+			logger.Error().Err(rmErr).Msgf("failed to remove the results written to %s", outputPath)
+		}
+		stepReport.Written = 0
+	}
+	if err != nil {
 		return fmt.Errorf("matcher.Match: %w", err)
 	}
 
+	c.report.setMatch(matcher)
+
 	logger.Info().Msg("Step 3: Match the two sets of triple encrypted PAIR IDs completed.")
 
 	return nil
 }
 
+// verifyPublisherData verifies that the publisher triple encrypted objects
+// are the ones recorded by step 2, reading them entirely as stored, and wraps
+// their readers so that reading them fails if their content is not the
+// recorded one. It only logs a warning when step 2 was not run from this
+// machine.
+func (c *pairConfig) verifyPublisherData(ctx context.Context, b *bucket.Readers, readers []io.Reader) error {
+	if c.integrityPath == "" {
+		return nil
+	}
+
+	record, err := loadIntegrityRecord(c.integrityPath)
+	if err != nil {
+		return fmt.Errorf("loadIntegrityRecord: %w", err)
+	}
+
+	if len(record.Objects) == 0 {
+		zerolog.Ctx(ctx).Warn().Msgf("no integrity record of step 2 found at %s, the publisher triple encrypted data cannot be verified", c.integrityPath)
+		return nil
+	}
+
+	objects := b.PubObjects
+	if err := record.verify(objects); err != nil {
+		return err
+	}
+
+	// the objects are read concurrently, up to the number of threads.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(c.threads, 1))
+	for _, obj := range objects {
+		g.Go(func() error {
+			r, err := b.NewPubStoredReader(gctx, obj)
+			if err != nil {
+				return fmt.Errorf("b.NewPubStoredReader: %w", err)
+			}
+			defer r.Close()
+
+			return record.verifyStored(obj.URL, r)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	for i, obj := range objects {
+		readers[i] = record.reader(obj.URL, readers[i])
+	}
+
+	return nil
+}
+
 func readersFromReadClosers(rs []io.ReadCloser) []io.Reader {
 	readers := make([]io.Reader, len(rs))
 	for i, r := range rs {
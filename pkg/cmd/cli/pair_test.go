@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitThreads(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		threads, objects  int
+		parallel, workers int
+	}{
+		{threads: 8, objects: 1, parallel: 1, workers: 8},
+		{threads: 8, objects: 2, parallel: 2, workers: 4},
+		{threads: 8, objects: 3, parallel: 3, workers: 2},
+		{threads: 8, objects: 100, parallel: 8, workers: 1},
+		{threads: 1, objects: 100, parallel: 1, workers: 1},
+		{threads: 4, objects: 0, parallel: 1, workers: 4},
+		{threads: 0, objects: 3, parallel: 1, workers: 1},
+	} {
+		parallel, workers := splitThreads(tc.threads, tc.objects)
+		require.Equal(t, tc.parallel, parallel, "parallel objects for %d threads and %d objects", tc.threads, tc.objects)
+		require.Equal(t, tc.workers, workers, "workers for %d threads and %d objects", tc.threads, tc.objects)
+	}
+}
@@ -0,0 +1,256 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/io"
+	"optable-pair-cli/pkg/pair"
+	"path/filepath"
+
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+)
+
+// planWriter prints the lines of a plan, keeping the first write error.
+type planWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *planWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+
+	_, p.err = fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+// writePlan prints which steps of the PAIR protocol a run would execute given the
+// participants' states, which objects would be read and written, and which state
+// advances would happen. It only reads from the clean room storage.
+func (c *RunCmd) writePlan(ctx context.Context, w io.Writer, pairCfg *pairConfig, publisherState, advertiserState v1.Cleanroom_Participant_State) error {
+	action, err := actionFromStates(publisherState, advertiserState)
+	if err != nil {
+		return err
+	}
+
+	client, err := pairCfg.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	p := &planWriter{w: w}
+	p.printf("Publisher state:  %s", publisherState)
+	p.printf("Advertiser state: %s", advertiserState)
+	p.printf("")
+
+	var (
+		runStepOne   = action.contributeAdvertiserData
+		runStepTwo   = (runStepOne || action.reEncryptPublisherData) && c.Until != stepOne
+		runStepThree = (runStepTwo || action.matchData) && c.Until == "" && c.Output != ""
+	)
+
+	if !action.contributeAdvertiserData && !action.reEncryptPublisherData && !action.matchData {
+		p.printf("Nothing can run in the current state.")
+		return p.err
+	}
+
+	// Step 1
+	p.printf("Step 1: hash and encrypt the advertiser data")
+	if runStepOne {
+		if err := c.planStepOne(ctx, p, pairCfg, client); err != nil {
+			return err
+		}
+		p.printf("  advance: advertiser state %s -> %s", v1.Cleanroom_Participant_INVITED, v1.Cleanroom_Participant_DATA_CONTRIBUTED)
+	} else {
+		p.printf("  skipped: already completed")
+	}
+
+	// Step 2
+	p.printf("Step 2: re-encrypt the publisher's hashed and encrypted PAIR IDs")
+	switch {
+	case runStepTwo:
+		if err := c.planStepTwo(ctx, p, pairCfg, client); err != nil {
+			return err
+		}
+		p.printf("  advance: advertiser state %s -> %s", v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_DATA_TRANSFORMED)
+	case action.contributeAdvertiserData:
+		p.printf("  skipped: --until=%s", c.Until)
+	default:
+		p.printf("  skipped: already completed")
+	}
+
+	// Step 3
+	p.printf("Step 3: match the two sets of triple encrypted PAIR IDs")
+	switch {
+	case runStepThree:
+		if err := c.planStepThree(ctx, p, pairCfg, client, runStepTwo); err != nil {
+			return err
+		}
+	case c.Until != "":
+		p.printf("  skipped: --until=%s", c.Until)
+	default:
+		p.printf("  skipped: no --output provided")
+	}
+
+	return p.err
+}
+
+func (c *RunCmd) planStepOne(ctx context.Context, p *planWriter, pairCfg *pairConfig, client *bucket.Client) error {
+	completed, err := hasCompleted(ctx, client, pairCfg.advTwicePath)
+	if err != nil {
+		return err
+	}
+
+	if completed {
+		p.printf("  upload:  skipped, %s/%s exists", pairCfg.advTwicePath, bucket.CompletedFile)
+		return nil
+	}
+
+	if c.Input == "" {
+		p.printf("  read:    stdin")
+	} else {
+		rows, err := countRows(c.Input)
+		if err != nil {
+			return err
+		}
+
+		p.printf("  read:    %s (%d rows)", c.Input, rows)
+		if rows < pair.MinimumIDCount {
+			p.printf("  warning: at least %d rows are required, step 1 would fail", pair.MinimumIDCount)
+		}
+	}
+
+	staging, err := bucket.StagingURL(pairCfg.advTwicePath)
+	if err != nil {
+		return fmt.Errorf("bucket.StagingURL: %w", err)
+	}
+
+	suffix := ""
+	if pairCfg.compress() {
+		suffix = ".gz"
+	}
+
+	name := "data_<random>.csv" + suffix
+	if pairCfg.shardRows > 0 || pairCfg.shardSize > 0 {
+		name = "data_<random>_<shard>.csv" + suffix
+	}
+
+	// the objects are staged, and promoted once all of them are written and verified.
+	p.printf("  write:   %s/%s", staging, name)
+	p.printf("  promote: %s/%s -> %s/%s", staging, name, pairCfg.advTwicePath, name)
+	p.printf("  write:   %s/%s", pairCfg.advTwicePath, bucket.ManifestFile)
+	p.printf("  write:   %s/%s", pairCfg.advTwicePath, bucket.CompletedFile)
+
+	return nil
+}
+
+func (c *RunCmd) planStepTwo(ctx context.Context, p *planWriter, pairCfg *pairConfig, client *bucket.Client) error {
+	completed, err := hasCompleted(ctx, client, pairCfg.pubTriplePath)
+	if err != nil {
+		return err
+	}
+
+	if completed {
+		p.printf("  upload:  skipped, %s/%s exists", pairCfg.pubTriplePath, bucket.CompletedFile)
+		return nil
+	}
+
+	objects, err := bucket.PlanReadWrites(ctx, client, pairCfg.pubTwicePath, pairCfg.pubTriplePath, pairCfg.compress())
+	if err != nil {
+		return fmt.Errorf("bucket.PlanReadWrites: %w", err)
+	}
+
+	// the objects re-encrypted by a previous run are not re-encrypted again,
+	// their local copy is read back from the stored object.
+	for i, obj := range objects {
+		p.printf("  read:    %s (%d bytes)", obj.Source.URL, obj.Source.Size)
+		if obj.Completed {
+			p.printf("  skipped: %s, already written from %s", obj.DestinationURL, obj.Source.URL)
+		} else {
+			p.printf("  write:   %s", obj.StagingURL)
+		}
+		if c.PublisherPAIRIDs != "" {
+			p.printf("  write:   %s", filepath.Join(c.PublisherPAIRIDs, fmt.Sprintf("pair_ids_%d.csv", i)))
+		}
+	}
+
+	for _, obj := range objects {
+		if !obj.Promoted {
+			p.printf("  promote: %s -> %s", obj.StagingURL, obj.DestinationURL)
+		}
+	}
+
+	p.printf("  write:   %s/%s", pairCfg.pubTriplePath, bucket.ManifestFile)
+	p.printf("  write:   %s/%s", pairCfg.pubTriplePath, bucket.CompletedFile)
+
+	return nil
+}
+
+func (c *RunCmd) planStepThree(ctx context.Context, p *planWriter, pairCfg *pairConfig, client *bucket.Client, afterStepTwo bool) error {
+	p.printf("  wait:    publisher state %s", v1.Cleanroom_Participant_DATA_TRANSFORMED)
+
+	if afterStepTwo {
+		p.printf("  read:    %s/*, written by the publisher after step 2", pairCfg.advTriplePath)
+	} else {
+		objects, err := bucket.ListObjects(ctx, client, pairCfg.advTriplePath)
+		if err != nil {
+			return fmt.Errorf("bucket.ListObjects: %w", err)
+		}
+
+		if len(objects) == 0 {
+			p.printf("  read:    %s/*, not written by the publisher yet", pairCfg.advTriplePath)
+		}
+
+		for _, obj := range objects {
+			p.printf("  read:    %s (%d bytes)", obj.URL, obj.Size)
+		}
+	}
+
+	if c.PublisherPAIRIDs != "" {
+		p.printf("  read:    %s", c.PublisherPAIRIDs)
+	} else {
+		p.printf("  read:    %s/*", pairCfg.pubTriplePath)
+	}
+
+	p.printf("  write:   %s", filepath.Join(c.Output, "result_<n>.csv"))
+
+	return nil
+}
+
+func hasCompleted(ctx context.Context, client *bucket.Client, url string) (bool, error) {
+	pBucket, err := bucket.ParseURL(url)
+	if err != nil {
+		return false, fmt.Errorf("bucket.ParseURL: %w", err)
+	}
+
+	completed, err := bucket.HasCompleted(ctx, client, pBucket)
+	if err != nil {
+		return false, fmt.Errorf("bucket.HasCompleted: %w", err)
+	}
+
+	return completed, nil
+}
+
+// countRows counts the CSV records of the input file, or of all files of the input directory.
+func countRows(input string) (int, error) {
+	fs, err := io.FileReaders(input)
+	if err != nil {
+		return 0, fmt.Errorf("io.FileReaders: %w", err)
+	}
+
+	r := csv.NewReader(io.MultiReader(fs...))
+	rows := 0
+	for {
+		_, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", input, err)
+		}
+		rows++
+	}
+}
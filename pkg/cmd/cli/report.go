@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"optable-pair-cli/pkg/metrics"
+	"optable-pair-cli/pkg/pair"
+	"os"
+	"time"
+)
+
+// Statuses of a step in a run report.
+const (
+	stepExecuted = "executed"
+	stepSkipped  = "skipped"
+)
+
+// Reasons for skipping a step in a run report.
+const (
+	reasonCompleted = "already completed"
+	reasonUploaded  = "already uploaded"
+	reasonUntil     = "stopped by --until"
+	reasonNoOutput  = "no output provided"
+)
+
+type (
+	// runReport is a machine-readable summary of a run, written to the path of the --report flag.
+	runReport struct {
+		Version   string        `json:"opair_version"`
+		Cleanroom string        `json:"cleanroom"`
+		KeyID     string        `json:"key_id"`
+		StartTime time.Time     `json:"start_time"`
+		Duration  float64       `json:"duration_seconds"`
+		Steps     []*stepReport `json:"steps"`
+		Match     *matchReport  `json:"match,omitempty"`
+		Error     string        `json:"error,omitempty"`
+		ErrorCode string        `json:"error_code,omitempty"`
+	}
+
+	stepReport struct {
+		Step           string   `json:"step"`
+		Status         string   `json:"status"`
+		Reason         string   `json:"reason,omitempty"`
+		Read           uint64   `json:"read"`
+		Written        uint64   `json:"written"`
+		Duration       float64  `json:"duration_seconds"`
+		ReadObjects    []string `json:"read_objects,omitempty"`
+		WrittenObjects []string `json:"written_objects,omitempty"`
+
+		startTime time.Time
+	}
+
+	// rowCounter is implemented by the PAIR operations, which count the rows they process.
+	rowCounter interface {
+		RowsRead() uint64
+		RowsWritten() uint64
+	}
+
+	matchReport struct {
+		AdvertiserRead uint64  `json:"advertiser_read"`
+		PublisherRead  uint64  `json:"publisher_read"`
+		Matched        uint64  `json:"matched"`
+		MatchRate      float64 `json:"match_rate"`
+	}
+)
+
+func newRunReport() *runReport {
+	return &runReport{
+		Version:   version,
+		StartTime: time.Now(),
+		Steps:     []*stepReport{},
+	}
+}
+
+// start records that a step is executed and returns its report to be filled
+// by the caller. It is safe to call on a nil report, in which case the returned
+// step report is discarded.
+func (r *runReport) start(step string) *stepReport {
+	s := &stepReport{
+		Step:      step,
+		Status:    stepExecuted,
+		startTime: time.Now(),
+	}
+
+	if r != nil {
+		r.Steps = append(r.Steps, s)
+	}
+
+	return s
+}
+
+// skip records that a step is skipped for the given reason. It is safe to call on a nil report.
+func (r *runReport) skip(step, reason string) {
+	if r == nil {
+		return
+	}
+
+	r.Steps = append(r.Steps, &stepReport{
+		Step:   step,
+		Status: stepSkipped,
+		Reason: reason,
+	})
+}
+
+// skipped marks an executed step as skipped, for instance when its output had already been uploaded.
+func (s *stepReport) skipped(reason string) {
+	s.Status = stepSkipped
+	s.Reason = reason
+}
+
+// addRows adds the rows processed by a PAIR operation to the step.
+func (s *stepReport) addRows(c rowCounter) {
+	s.Read += c.RowsRead()
+	s.Written += c.RowsWritten()
+}
+
+// finish records the duration of the step, in the report and in the metrics.
+func (s *stepReport) finish() {
+	s.Duration = time.Since(s.startTime).Seconds()
+	metrics.StepDuration.WithLabelValues(s.Step, s.Status).Observe(s.Duration)
+}
+
+// setMatch records the result of the match. It is safe to call on a nil report.
+func (r *runReport) setMatch(m *pair.Matcher) {
+	if r == nil {
+		return
+	}
+
+	r.Match = &matchReport{
+		AdvertiserRead: m.AdvertiserRowsRead(),
+		PublisherRead:  m.PublisherRowsRead(),
+		Matched:        m.Matched(),
+		MatchRate:      m.MatchRate(),
+	}
+}
+
+// write writes the report as JSON to the given path, along with the error that ended the run, if any.
+func (r *runReport) write(path string, runErr error) error {
+	r.Duration = time.Since(r.StartTime).Seconds()
+	if runErr != nil {
+		r.Error = runErr.Error()
+		r.ErrorCode = ErrorCode(runErr)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+
+	// 0600: rw-------, the report contains the key ID.
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
@@ -3,17 +3,40 @@ package cli
 import (
 	"context"
 	"fmt"
+	"optable-pair-cli/pkg/internal"
+	"os"
+	"time"
 
 	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"github.com/rs/zerolog"
+)
+
+// waitLogInterval is the interval at which the publisher state is logged
+// while waiting, when it does not change.
+const waitLogInterval = 1 * time.Minute
+
+// Identifiers of the PAIR steps, used by the --until flag and in run reports.
+const (
+	stepOne   = "step1"
+	stepTwo   = "step2"
+	stepThree = "step3"
 )
 
 type (
 	RunCmd struct {
-		PairCleanroomToken string `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
-		Input              string `cmd:"" short:"i" help:"The path to the input file containing the newline separated list of canonicalized email addresses for encrypted PAIR matching. The expected canonical form of an email address is obtained by trimming leading and trailing spaces, downcasing, and applying the SHA256 hash function without a salt. If a directory path is provided, all files within the directory will be processed."`
-		NumThreads         int    `cmd:"" short:"n" help:"The number of threads to use for the operation. Defaults to the number of the available cores on the machine."`
-		Output             string `cmd:"" short:"o" help:"The path to the output file to write the intersected publisher PAIR IDs to. If not provided, the intersection will not happen."`
-		PublisherPAIRIDs   string `cmd:"" name:"save-publisher-encrypted-data-locally" short:"s" help:" During the encryption stages of the PAIR protocol for 2 clean rooms, the advertiser clean room must encrypt the publisher clean room dataset with the advertiser clean room's private key. The publisher triple encrypted dataset is sent to the Optable publisher clean room where it is temporarily stored in GCS so that the intersection can be computed in the final stage. Setting this flag causes the opair utility to save a local copy of the triple encrypted publisher dataset and to use the locally saved copy when calculating the intersection. If not provided, opair will download both triple encrypted datasets from the GCS location managed by the Optable publisher clean room and assume that they have not been tampered with. Note that if you specify the -s flag without specifying -o then when you later re-run with -o you must also include the -s flag from the first run."`
+		PairCleanroomToken string        `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+		Input              string        `cmd:"" short:"i" help:"The path to the input file containing the newline separated list of canonicalized email addresses for encrypted PAIR matching. The expected canonical form of an email address is obtained by trimming leading and trailing spaces, downcasing, and applying the SHA256 hash function without a salt. If a directory path is provided, all files within the directory will be processed."`
+		NumThreads         int           `cmd:"" short:"n" help:"The number of threads to use for the operation. Defaults to the number of the available cores on the machine."`
+		ShardRows          int64         `cmd:"" help:"Upload the encrypted advertiser data of step 1 as numbered objects of at most the given number of rows, uploaded concurrently, up to --num-threads at a time. A single object is uploaded by default."`
+		ShardSize          byteSize      `cmd:"" help:"Upload the encrypted advertiser data of step 1 as numbered objects of about the given size, e.g. 512MiB, uploaded concurrently, up to --num-threads at a time. A single object is uploaded by default."`
+		Compression        string        `cmd:"" enum:"gzip,none" default:"none" help:"Compress the data uploaded by steps 1 and 2 with gzip, to reduce egress. Only use gzip when the clean room reads compressed data. Valid options: [gzip,none]"`
+		Output             string        `cmd:"" short:"o" help:"The path to the output file to write the intersected publisher PAIR IDs to. If not provided, the intersection will not happen."`
+		PublisherPAIRIDs   string        `cmd:"" name:"save-publisher-encrypted-data-locally" short:"s" help:" During the encryption stages of the PAIR protocol for 2 clean rooms, the advertiser clean room must encrypt the publisher clean room dataset with the advertiser clean room's private key. The publisher triple encrypted dataset is sent to the Optable publisher clean room where it is temporarily stored in GCS so that the intersection can be computed in the final stage. Setting this flag causes the opair utility to save a local copy of the triple encrypted publisher dataset and to use the locally saved copy when calculating the intersection. If not provided, opair will download both triple encrypted datasets from the GCS location managed by the Optable publisher clean room, and verify the publisher triple encrypted dataset against the digests recorded locally while re-encrypting it, failing if it has been tampered with. Note that if you specify the -s flag without specifying -o then when you later re-run with -o you must also include the -s flag from the first run."`
+		Wait               bool          `cmd:"" help:"If the publisher has not contributed its data to the clean room yet, wait for it to do so instead of failing."`
+		WaitTimeout        time.Duration `cmd:"" default:"24h" help:"The maximum time to wait for the publisher to contribute its data when --wait is set, before step 1. It replaces --poll-timeout for this wait only."`
+		Until              string        `cmd:"" enum:",step1,step2" default:"" help:"Stop after the given step of the PAIR protocol instead of running all of them. Valid options: [step1,step2]"`
+		Report             string        `cmd:"" help:"Write a JSON report of the run to the given path, with the steps executed or skipped, their row counts, durations and objects, and the match rate."`
+		Plan               bool          `cmd:"" help:"Print which steps would run, which objects would be read and written, and which state advances would happen, without uploading anything or advancing the clean room state."`
 	}
 )
 
@@ -43,46 +66,81 @@ the same <pair-cleanroom-token> and specifying the --output flag.
 The` + " `run` " + `command on a specified <pair-cleanroom-token> can recover from a
 failure at any step, and will resume from the
 last successful step.
+
+When the publisher has not contributed its data to the clean room yet, the` + " `run` " + `
+command fails unless the --wait flag is provided, in which case it waits for
+the publisher for up to --wait-timeout before starting. Waiting stops
+immediately if the publisher rejects, revokes or fails the clean room.
+--wait-timeout only bounds this wait: the wait for the publisher to
+re-encrypt the advertiser data before the match is bounded by --poll-timeout.
+
+The --until flag stops the` + " `run` " + `command after step1 (encrypting and sending the
+advertiser data) or step2 (re-encrypting the publisher data). The steps can
+also be run individually with the` + " `encrypt`, `reencrypt` and `match` " + `commands.
+
+The --plan flag prints what the` + " `run` " + `command would do given the current state of
+the clean room, without uploading anything or advancing the clean room state.
+
+On failure, the exit code of opair tells the cause of the failure apart, see
+the README for the list of exit codes.
 `
 }
 
-func (c *RunCmd) Run(cli *CmdContext) error {
+func (c *RunCmd) Run(cli *CmdContext) (err error) {
+	if c.Report == "" {
+		return c.run(cli, nil)
+	}
+
+	report := newRunReport()
+	defer func() {
+		if writeErr := report.write(c.Report, err); writeErr != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to write run report: %w", writeErr)
+				return
+			}
+
+			cli.Log().Error().Err(writeErr).Msg("failed to write run report")
+		}
+	}()
+
+	return c.run(cli, report)
+}
+
+func (c *RunCmd) run(cli *CmdContext, report *runReport) error {
 	ctx := cli.Context()
 
-	advertiserKey, err := ReadKeyConfig(cli.keyContext, cli.config)
+	// instantiate the pair configuration
+	pairCfg, err := newPAIRConfigFromCLI(cli, c.PairCleanroomToken, c.NumThreads)
 	if err != nil {
-		return fmt.Errorf("ReadKeyConfig: %w", err)
+		return err
 	}
+	pairCfg.shardRows, pairCfg.shardSize = c.ShardRows, int64(c.ShardSize)
+	pairCfg.compression = c.Compression
 
-	if c.NumThreads <= 0 {
-		c.NumThreads = defaultThreadCount
+	if report != nil {
+		report.Cleanroom = pairCfg.cleanroomName
+		report.KeyID = pairCfg.keyID
+		pairCfg.report = report
 	}
 
-	// instantiate the pair configuration
-	pairCfg, err := newPAIRConfig(ctx, c.PairCleanroomToken, c.NumThreads, advertiserKey)
+	// Get the state of the publisher and advertiser
+	publisherState, advertiserState, err := pairCfg.participantStates(ctx)
 	if err != nil {
 		return err
 	}
 
-	cleanroom, err := pairCfg.cleanroomClient.GetCleanroom(ctx, false)
-	if err != nil {
-		return fmt.Errorf("GetCleanroom: %w", err)
+	if c.Plan {
+		return c.writePlan(ctx, os.Stdout, pairCfg, publisherState, advertiserState)
 	}
 
-	// Get the state of the publisher and advertiser
-	var (
-		publisherState  v1.Cleanroom_Participant_State
-		advertiserState v1.Cleanroom_Participant_State
-	)
+	if c.Wait && !publisherHasContributed(publisherState) {
+		if err := waitForPublisher(ctx, pairCfg.cleanroomClient, c.WaitTimeout); err != nil {
+			return err
+		}
 
-	for _, p := range cleanroom.GetParticipants() {
-		switch p.GetRole() {
-		case v1.Cleanroom_Participant_PUBLISHER:
-			publisherState = p.GetState()
-		case v1.Cleanroom_Participant_ADVERTISER:
-			advertiserState = p.GetState()
-		case v1.Cleanroom_Participant_ROLE_UNSPECIFIED:
-			return fmt.Errorf("role unspecified for participant")
+		publisherState, advertiserState, err = pairCfg.participantStates(ctx)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -100,18 +158,97 @@ func (c *RunCmd) Run(cli *CmdContext) error {
 	}
 
 	if action.contributeAdvertiserData {
-		return startFromStepOne(ctx, pairCfg, c.Input, c.Output, c.PublisherPAIRIDs)
+		return startFromStepOne(ctx, pairCfg, c.Input, c.Output, c.PublisherPAIRIDs, c.Until)
 	}
 
 	if action.reEncryptPublisherData {
-		return startFromStepTwo(ctx, pairCfg, c.Output, c.PublisherPAIRIDs)
+		pairCfg.report.skip(stepOne, reasonCompleted)
+		if c.Until == stepOne {
+			return alreadyCompleted(ctx, c.Until)
+		}
+
+		return startFromStepTwo(ctx, pairCfg, c.Output, c.PublisherPAIRIDs, c.Until)
 	}
 
 	if action.matchData {
+		pairCfg.report.skip(stepOne, reasonCompleted)
+		pairCfg.report.skip(stepTwo, reasonCompleted)
+		if c.Until != "" {
+			return alreadyCompleted(ctx, c.Until)
+		}
+
 		return startFromStepThree(ctx, pairCfg, c.Output, c.PublisherPAIRIDs)
 	}
 
-	return fmt.Errorf("unexpected advertiser state: %s and publisher state: %s", advertiserState, publisherState)
+	return fmt.Errorf("%w: unexpected advertiser state: %s and publisher state: %s", ErrInvalidState, advertiserState, publisherState)
+}
+
+// alreadyCompleted logs that there is nothing to do since the clean room is already past the requested step.
+func alreadyCompleted(ctx context.Context, until string) error {
+	zerolog.Ctx(ctx).Info().Msgf("%s has already been completed, nothing to do", until)
+	return nil
+}
+
+// participantStates returns the state of the publisher and the advertiser of the clean room.
+func participantStates(cleanroom *v1.Cleanroom) (publisherState, advertiserState v1.Cleanroom_Participant_State, err error) {
+	for _, p := range cleanroom.GetParticipants() {
+		switch p.GetRole() {
+		case v1.Cleanroom_Participant_PUBLISHER:
+			publisherState = p.GetState()
+		case v1.Cleanroom_Participant_ADVERTISER:
+			advertiserState = p.GetState()
+		case v1.Cleanroom_Participant_ROLE_UNSPECIFIED:
+			return publisherState, advertiserState, fmt.Errorf("%w: role unspecified for participant", ErrInvalidState)
+		}
+	}
+
+	return publisherState, advertiserState, nil
+}
+
+// publisherHasContributed returns false when the publisher has yet to contribute its data.
+func publisherHasContributed(publisherState v1.Cleanroom_Participant_State) bool {
+	return publisherState != v1.Cleanroom_Participant_INVITED &&
+		publisherState != v1.Cleanroom_Participant_DATA_CONTRIBUTING
+}
+
+// waitForPublisher blocks until the publisher has contributed its data. State
+// changes are logged by the clean room client, and the publisher state and the
+// time spent waiting are logged on the first poll, then every waitLogInterval.
+func waitForPublisher(ctx context.Context, client *internal.CleanroomClient, timeout time.Duration) error {
+	logger := zerolog.Ctx(ctx)
+	logger.Info().Msgf("waiting up to %s for publisher to contribute data", timeout)
+
+	progress := &waitProgress{logger: logger, interval: waitLogInterval}
+	err := client.PublisherContributed(
+		ctx,
+		internal.WithWaitTimeout(timeout),
+		internal.WithStateObserver(progress.observe),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to wait for publisher: %w", err)
+	}
+
+	return nil
+}
+
+// waitProgress logs the publisher state and the time spent waiting for it,
+// right away and then at most once per interval.
+type waitProgress struct {
+	logger     *zerolog.Logger
+	interval   time.Duration
+	lastLogged time.Time
+}
+
+func (p *waitProgress) observe(state v1.Cleanroom_Participant_State, elapsed time.Duration) {
+	if !p.lastLogged.IsZero() && time.Since(p.lastLogged) < p.interval {
+		return
+	}
+
+	p.lastLogged = time.Now()
+	p.logger.Info().
+		Str("publisher_state", state.String()).
+		Str("elapsed", elapsed.Round(time.Second).String()).
+		Msg("waiting for publisher to contribute data")
 }
 
 type action struct {
@@ -163,7 +300,7 @@ func actionFromStates(publisherState, advertiserState v1.Cleanroom_Participant_S
 	case v1.Cleanroom_Participant_REJECTED:
 		fallthrough
 	case v1.Cleanroom_Participant_REVOKED:
-		return nil, fmt.Errorf("invalid publisher state: %s", publisherState)
+		return nil, fmt.Errorf("%w: invalid publisher state: %s", ErrInvalidState, publisherState)
 	case v1.Cleanroom_Participant_INVITED:
 		fallthrough
 	case v1.Cleanroom_Participant_DATA_CONTRIBUTING:
@@ -174,26 +311,38 @@ func actionFromStates(publisherState, advertiserState v1.Cleanroom_Participant_S
 	return &action{}, nil
 }
 
-func startFromStepOne(ctx context.Context, pairCfg *pairConfig, input, output string, publisherData string) error {
+func startFromStepOne(ctx context.Context, pairCfg *pairConfig, input, output, publisherData, until string) error {
 	// Step 1 Hash and encrypt the advertiser data and output to advTwicePath.
-	if err := pairCfg.hashEncryt(ctx, input); err != nil {
-		return fmt.Errorf("hashEncryt: %w", err)
+	if err := runStepOne(ctx, pairCfg, input); err != nil {
+		return err
 	}
 
-	if _, err := pairCfg.cleanroomClient.AdvanceAdvertiserState(ctx); err != nil {
-		return fmt.Errorf("failed to advance advertiser state: %w", err)
+	if until == stepOne {
+		pairCfg.report.skip(stepTwo, reasonUntil)
+		pairCfg.report.skip(stepThree, reasonUntil)
+		return nil
 	}
 
+	return startFromStepTwo(ctx, pairCfg, output, publisherData, until)
+}
+
+func startFromStepTwo(ctx context.Context, pairCfg *pairConfig, output, publisherData, until string) error {
 	// Step 2. Re-encrypt the publisher's hashed and encrypted PAIR IDs and output to pubTriplePath.
-	if err := pairCfg.reEncrypt(ctx, publisherData); err != nil {
-		return fmt.Errorf("reEncrypt: %w", err)
+	if err := runStepTwo(ctx, pairCfg, publisherData); err != nil {
+		return err
 	}
 
-	if _, err := pairCfg.cleanroomClient.AdvanceAdvertiserState(ctx); err != nil {
-		return fmt.Errorf("failed to advance advertiser state: %w", err)
+	if until == stepTwo {
+		pairCfg.report.skip(stepThree, reasonUntil)
+		return nil
 	}
 
+	return startFromStepThree(ctx, pairCfg, output, publisherData)
+}
+
+func startFromStepThree(ctx context.Context, pairCfg *pairConfig, output string, publisherData string) error {
 	if output == "" {
+		pairCfg.report.skip(stepThree, reasonNoOutput)
 		return nil
 	}
 
@@ -201,29 +350,28 @@ func startFromStepOne(ctx context.Context, pairCfg *pairConfig, input, output st
 	return pairCfg.match(ctx, output, publisherData)
 }
 
-func startFromStepTwo(ctx context.Context, pairCfg *pairConfig, output string, publisherData string) error {
-	// Step 2. Re-encrypt the publisher's hashed and encrypted PAIR IDs and output to pubTriplePath.
-	if err := pairCfg.reEncrypt(ctx, publisherData); err != nil {
-		return fmt.Errorf("reEncrypt: %w", err)
+// runStepOne hashes and encrypts the advertiser data, then advances the advertiser state.
+func runStepOne(ctx context.Context, pairCfg *pairConfig, input string) error {
+	if err := pairCfg.hashEncryt(ctx, input); err != nil {
+		return fmt.Errorf("hashEncryt: %w", err)
 	}
 
 	if _, err := pairCfg.cleanroomClient.AdvanceAdvertiserState(ctx); err != nil {
 		return fmt.Errorf("failed to advance advertiser state: %w", err)
 	}
 
-	if output == "" {
-		return nil
-	}
-
-	// Step 3. Match the two sets of triple encrypted PAIR IDs and output the intersected PAIR IDs to output.
-	return pairCfg.match(ctx, output, publisherData)
+	return nil
 }
 
-func startFromStepThree(ctx context.Context, pairCfg *pairConfig, output string, publisherData string) error {
-	if output == "" {
-		return nil
+// runStepTwo re-encrypts the publisher data, then advances the advertiser state.
+func runStepTwo(ctx context.Context, pairCfg *pairConfig, publisherData string) error {
+	if err := pairCfg.reEncrypt(ctx, publisherData); err != nil {
+		return fmt.Errorf("reEncrypt: %w", err)
 	}
 
-	// Step 3. Match the two sets of triple encrypted PAIR IDs and output the intersected PAIR IDs to output.
-	return pairCfg.match(ctx, output, publisherData)
+	if _, err := pairCfg.cleanroomClient.AdvanceAdvertiserState(ctx); err != nil {
+		return fmt.Errorf("failed to advance advertiser state: %w", err)
+	}
+
+	return nil
 }
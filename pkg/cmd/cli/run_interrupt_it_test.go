@@ -0,0 +1,73 @@
+//go:build unix
+
+package cli
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"google.golang.org/api/iterator"
+)
+
+func (s *cmdTestSuite) TestRun_Interrupted() {
+	cleanroom := s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	// the input is a named pipe which stalls once a few batches are written,
+	// so that opair is interrupted while uploading them. The first objects
+	// are committed by then, and must be deleted.
+	input := filepath.Join(s.tmpDir, "input.fifo")
+	err := syscall.Mkfifo(input, 0600)
+	s.Require().NoError(err, "must create named pipe")
+
+	cmdCtx := s.requireNewCmdContext()
+	finished := make(chan struct{})
+	go func() {
+		f, err := os.OpenFile(input, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		w := csv.NewWriter(f)
+		for range 3 {
+			for _, email := range s.params.emailsSource {
+				_ = w.Write([]string{email})
+			}
+		}
+		w.Flush()
+
+		time.Sleep(500 * time.Millisecond)
+		cmdCtx.interrupt(syscall.SIGINT)
+		<-finished
+	}()
+
+	runCommand := RunCmd{
+		PairCleanroomToken: s.requireGenerateToken(server.URL, s.params.cleanroomName, s.params.salt),
+		Input:              input,
+		NumThreads:         1,
+		ShardRows:          1000,
+		Output:             s.params.advertiserOutputFolderPath,
+	}
+
+	err = runCommand.Run(cmdCtx)
+	close(finished)
+	s.Require().ErrorIs(err, ErrInterrupted)
+	s.Require().Equal(ExitInterrupted, ExitCode(cmdCtx.Interrupted(err)))
+
+	// neither the partial object nor the .Completed marker are committed, and the state is not advanced.
+	it := s.gcsClient.Bucket(s.sampleBucket).Objects(s.ctx, &storage.Query{Prefix: s.advertiserTwiceEncryptedFolder() + "/"})
+	_, err = it.Next()
+	s.Require().True(errors.Is(err, iterator.Done), "must not commit any object, got %v", err)
+	it = s.gcsClient.Bucket(s.sampleBucket).Objects(s.ctx, &storage.Query{Prefix: s.advertiserTwiceEncryptedFolder() + "/.staging/"})
+	_, err = it.Next()
+	s.Require().True(errors.Is(err, iterator.Done), "must delete the staged objects, got %v", err)
+	s.Require().Equal(v1.Cleanroom_Participant_INVITED, cleanroom.Participants[1].State, "must not advance the state")
+}
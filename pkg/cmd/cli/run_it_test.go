@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
@@ -8,6 +9,7 @@ import (
 	"encoding/base64"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +18,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +32,7 @@ import (
 	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
 	"github.com/optable/match/pkg/pair"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -44,9 +49,14 @@ type cmdTestSuite struct {
 	suite.Suite
 
 	// suite parameters for all tests
-	ctx          context.Context
-	gcsClient    *storage.Client
-	sampleBucket string
+	ctx           context.Context
+	gcsClient     *storage.Client
+	storageClient *obucket.Client
+	sampleBucket  string
+	// emulatorURL is the URL of the storage emulator, and storageOptions the
+	// options of the opair storage clients reaching it.
+	emulatorURL    string
+	storageOptions []obucket.ClientOption
 
 	// unique params for each test case
 	tmpDir string
@@ -123,6 +133,15 @@ func (s *cmdTestSuite) SetupSuite() {
 	s.Require().NoError(err, "must create bucket")
 	s.gcsClient = client
 
+	// the opair storage clients are given the emulator explicitly as well.
+	s.emulatorURL = bucketURL
+	s.storageOptions = []obucket.ClientOption{
+		obucket.WithEndpoint(bucketURL),
+		obucket.WithHTTPClient(insecureGCSHTTPClient),
+	}
+	s.storageClient, err = obucket.NewClient("token", s.storageOptions...)
+	s.Require().NoError(err, "must create opair storage client")
+
 	// generate emails source once for all tests
 	s.params.emailsSource = make([]string, genEmailsSourceNumber)
 	shaEncoder := sha256.New()
@@ -134,6 +153,13 @@ func (s *cmdTestSuite) SetupSuite() {
 }
 
 func (s *cmdTestSuite) TearDownAllSuite() {
+	defer func() {
+		if s.storageClient == nil {
+			return
+		}
+		err := s.storageClient.Close()
+		s.Require().NoError(err, "must close opair storage client")
+	}()
 	defer func() {
 		if s.gcsClient == nil {
 			return
@@ -221,7 +247,284 @@ func (s *cmdTestSuite) TestRun_StepTwo_TransformedContributed() {
 	s.testRun(1, s.newCleanroom(v1.Cleanroom_Participant_DATA_TRANSFORMED, v1.Cleanroom_Participant_DATA_CONTRIBUTED))
 }
 
-func (s *cmdTestSuite) requirePrepareForStepTwo() {
+func (s *cmdTestSuite) TestEncrypt_ShardRows() {
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.threads = 2
+		c.shardRows = 300
+	})
+	err := cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
+	s.Require().NoError(err)
+
+	rows := s.requireShardRows(s.advertiserTwiceEncryptedFolder())
+	s.Require().Equal([]int{300, 300, 300, 101}, rows, "must roll over to a new object every 300 rows")
+}
+
+func (s *cmdTestSuite) TestEncrypt_ShardSize() {
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.threads = 2
+		c.shardSize = 10000
+	})
+	err := cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
+	s.Require().NoError(err)
+
+	it := s.gcsClient.Bucket(s.sampleBucket).Objects(s.ctx, &storage.Query{Prefix: s.advertiserTwiceEncryptedFolder() + "/data_"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		s.Require().NoError(err, "must list objects")
+		s.Require().Less(attrs.Size, int64(10100), "must roll over to a new object once about 10000 bytes are written")
+	}
+
+	rows := s.requireShardRows(s.advertiserTwiceEncryptedFolder())
+	s.Require().Greater(len(rows), 1, "must write several objects")
+}
+
+// requireShardRows returns the number of rows of each numbered object of the
+// folder, in order, checking that they only hold full rows.
+func (s *cmdTestSuite) requireShardRows(folder string) []int {
+	s.T().Helper()
+
+	var (
+		rows  []int
+		total int
+	)
+	it := s.gcsClient.Bucket(s.sampleBucket).Objects(s.ctx, &storage.Query{Prefix: folder + "/data_"})
+	for i := 0; ; i++ {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		s.Require().NoError(err, "must list objects")
+		s.Require().True(strings.HasSuffix(attrs.Name, fmt.Sprintf("_%05d.csv", i)), "must number the objects, got %s", attrs.Name)
+
+		r, err := s.gcsClient.Bucket(s.sampleBucket).Object(attrs.Name).NewReader(s.ctx)
+		s.Require().NoError(err, "must open object")
+		data, err := io.ReadAll(r)
+		s.Require().NoError(err, "must read object")
+		s.Require().NoError(r.Close())
+		s.Require().True(bytes.HasSuffix(data, []byte("\n")), "object must end with a full row")
+
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		s.Require().NoError(err, "must read records")
+		rows = append(rows, len(records))
+		total += len(records)
+	}
+	s.Require().Equal(genEmailsSourceNumber, total, "must write all the rows")
+
+	return rows
+}
+
+func (s *cmdTestSuite) TestReEncrypt_MultipleObjects() {
+	// arrange
+	s.requirePrepareForStepTwo()
+
+	// the publisher ships its data in several objects, re-encrypted concurrently.
+	numObjects := 4
+	for i := range numObjects {
+		s.requireGenPublisherTwiceEncryptedShard(i)
+	}
+
+	server := s.newAdvancingServer(s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_DATA_CONTRIBUTED))
+	defer server.Close()
+
+	reEncryptCommand := ReEncryptCmd{
+		PairCleanroomToken: s.requireGenerateToken(server.URL, s.params.cleanroomName, s.params.salt),
+		NumThreads:         3,
+		PublisherPAIRIDs:   s.params.publisherPAIRIDsFolderPath,
+	}
+
+	// act
+	err := reEncryptCommand.Run(s.requireNewCmdContext())
+	s.Require().NoError(err)
+
+	// assert
+	entries, err := os.ReadDir(s.params.publisherPAIRIDsFolderPath)
+	s.Require().NoError(err)
+	s.Require().Len(entries, numObjects+1, "must write a local copy of each object")
+	s.requireLocalContentEqualToGCSContent(s.params.publisherPAIRIDsFolderPath, s.publisherTripleEncryptedFolder())
+}
+
+func (s *cmdTestSuite) TestReEncrypt_Resume() {
+	// arrange
+	s.requirePrepareForStepTwo()
+	for i := range 2 {
+		s.requireGenPublisherTwiceEncryptedShard(i)
+	}
+
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.threads = 2
+	})
+	err := cfg.reEncrypt(s.ctx, s.params.publisherPAIRIDsFolderPath)
+	s.Require().NoError(err)
+
+	// the objects are named after their source objects.
+	generations := s.requireObjectGenerations(s.publisherTripleEncryptedFolder())
+	s.Require().Contains(generations, s.publisherTripleEncryptedFolder()+"/data.csv")
+	s.Require().Contains(generations, s.publisherTripleEncryptedFolder()+"/shard_0.csv")
+	s.Require().Contains(generations, s.publisherTripleEncryptedFolder()+"/shard_1.csv")
+	s.Require().Len(generations, 5, "must write the objects, the manifest and the .Completed marker")
+
+	// a run failed after re-encrypting some of the objects.
+	bucket := s.gcsClient.Bucket(s.sampleBucket)
+	s.Require().NoError(bucket.Object(s.publisherTripleEncryptedFolder() + "/" + obucket.CompletedFile).Delete(s.ctx))
+	s.Require().NoError(bucket.Object(s.publisherTripleEncryptedFolder() + "/shard_1.csv").Delete(s.ctx))
+	s.Require().NoError(os.RemoveAll(s.params.publisherPAIRIDsFolderPath))
+
+	// act
+	err = cfg.reEncrypt(s.ctx, s.params.publisherPAIRIDsFolderPath)
+	s.Require().NoError(err)
+
+	// assert
+	resumed := s.requireObjectGenerations(s.publisherTripleEncryptedFolder())
+	s.Require().Len(resumed, 5, "must write the missing object, the manifest and the .Completed marker")
+	s.Require().Equal(generations[s.publisherTripleEncryptedFolder()+"/data.csv"], resumed[s.publisherTripleEncryptedFolder()+"/data.csv"], "must skip completed objects")
+	s.Require().Equal(generations[s.publisherTripleEncryptedFolder()+"/shard_0.csv"], resumed[s.publisherTripleEncryptedFolder()+"/shard_0.csv"], "must skip completed objects")
+	s.requireLocalContentEqualToGCSContent(s.params.publisherPAIRIDsFolderPath, s.publisherTripleEncryptedFolder())
+}
+
+func (s *cmdTestSuite) TestReEncrypt_FailedAttempt() {
+	// arrange
+	s.requirePrepareForStepTwo()
+	s.requireGenPublisherTwiceEncryptedShard(0)
+
+	// an object below the minimum number of identifiers fails to re-encrypt.
+	w := s.gcsClient.Bucket(s.sampleBucket).Object(s.publisherTwiceEncryptedFolder() + "/small.csv").NewWriter(s.ctx)
+	csvWriter := csv.NewWriter(w)
+	s.Require().NoError(csvWriter.WriteAll([][]string{{"not enough"}}))
+	s.Require().NoError(w.Close())
+
+	cfg := s.newPairConfig()
+
+	// act
+	err := cfg.reEncrypt(s.ctx, "")
+
+	// assert
+	s.Require().Error(err)
+	s.Require().Empty(s.requireObjectGenerations(s.publisherTripleEncryptedFolder()), "must leave the destination untouched")
+	s.Require().NotEmpty(s.requireObjectGenerations(s.publisherTripleEncryptedFolder()+"/.staging"), "must keep the objects re-encrypted to resume")
+}
+
+func (s *cmdTestSuite) TestEncrypt_Promote() {
+	// an earlier attempt from the same input left objects under the destination and staging prefixes.
+	bucket := s.gcsClient.Bucket(s.sampleBucket)
+	for _, name := range []string{
+		s.advertiserTwiceEncryptedFolder() + "/data_stale.csv",
+		s.advertiserTwiceEncryptedFolder() + "/.staging/data_stale.csv",
+	} {
+		w := bucket.Object(name).NewWriter(s.ctx)
+		w.Metadata = map[string]string{"opair-source": inputSource(s.params.advertiserInputFilePath)}
+		_, err := w.Write([]byte("stale\n"))
+		s.Require().NoError(err)
+		s.Require().NoError(w.Close())
+	}
+
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.shardRows = 500
+	})
+	err := cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
+	s.Require().NoError(err)
+
+	s.Require().Empty(s.requireObjectGenerations(s.advertiserTwiceEncryptedFolder()+"/.staging"), "must promote all the staged objects")
+	generations := s.requireObjectGenerations(s.advertiserTwiceEncryptedFolder())
+	s.Require().NotContains(generations, s.advertiserTwiceEncryptedFolder()+"/data_stale.csv", "must delete the objects of earlier attempts")
+	s.Require().Contains(generations, s.advertiserTwiceEncryptedFolder()+"/"+obucket.CompletedFile)
+	s.Require().Equal([]int{500, 500, 1}, s.requireShardRows(s.advertiserTwiceEncryptedFolder()))
+}
+
+func (s *cmdTestSuite) TestEncrypt_PromoteForeignObject() {
+	// an object not written by opair from the same input is under the destination prefix.
+	foreign := s.advertiserTwiceEncryptedFolder() + "/data_foreign.csv"
+	w := s.gcsClient.Bucket(s.sampleBucket).Object(foreign).NewWriter(s.ctx)
+	_, err := w.Write([]byte("foreign\n"))
+	s.Require().NoError(err)
+	s.Require().NoError(w.Close())
+	before := s.requireObjectGenerations(s.advertiserTwiceEncryptedFolder())
+
+	cfg := s.newPairConfig()
+	err = cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
+
+	s.Require().ErrorIs(err, obucket.ErrForeignObject)
+	s.Require().Equal(before, s.requireObjectGenerations(s.advertiserTwiceEncryptedFolder()), "must leave the destination untouched")
+}
+
+func (s *cmdTestSuite) TestEncrypt_Manifest() {
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.shardRows = 500
+	})
+	err := cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
+	s.Require().NoError(err)
+
+	manifest, err := obucket.ReadManifest(s.ctx, s.storageClient, s.advertiserTwiceEncryptedGCSFolder())
+	s.Require().NoError(err)
+
+	fingerprint, err := keys.Fingerprint(s.params.advertiserKeyConfig.Key)
+	s.Require().NoError(err)
+	s.Require().Equal(stepOne, manifest.Step)
+	s.Require().Equal(fingerprint, manifest.KeyFingerprint)
+	s.Require().NotContains(fingerprint, s.params.advertiserKeyConfig.Key)
+	s.Require().Equal(s.advertiserTwiceEncryptedGCSFolder(), manifest.URL)
+
+	// the manifest describes the objects as stored.
+	s.Require().Len(manifest.Objects, 3)
+	for i, obj := range manifest.Objects {
+		s.Require().Equal([]int64{500, 500, 1}[i], obj.Rows)
+
+		u, err := url.Parse(obj.URL)
+		s.Require().NoError(err)
+		attrs, err := s.gcsClient.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).Attrs(s.ctx)
+		s.Require().NoError(err)
+		s.Require().Equal(attrs.Size, obj.Size)
+		s.Require().Equal(fmt.Sprintf("%08x", attrs.CRC32C), obj.CRC32C)
+	}
+}
+
+func (s *cmdTestSuite) TestManifestShow() {
+	s.requirePrepareForStepThree()
+
+	out := &bytes.Buffer{}
+	err := writeManifests(s.ctx, out, s.newPairConfig(), []dataPath{
+		{"advertiser twice encrypted", s.advertiserTwiceEncryptedGCSFolder()},
+		{"publisher twice encrypted", s.publisherTwiceEncryptedGCSFolder()},
+		{"publisher triple encrypted", s.publisherTripleEncryptedGCSFolder()},
+	})
+	s.Require().NoError(err)
+
+	sections := strings.Split(out.String(), "\n\n")
+	s.Require().Len(sections, 3)
+	s.Require().Contains(sections[0], "step:            "+stepOne)
+	s.Require().Contains(sections[0], "objects:         1, 1001 rows")
+	s.Require().Contains(sections[1], "no manifest", "the publisher data is not uploaded by opair")
+	s.Require().Contains(sections[2], "step:            "+stepTwo)
+}
+
+// requireObjectGenerations returns the generation of each object of the folder, by name.
+func (s *cmdTestSuite) requireObjectGenerations(folder string) map[string]int64 {
+	s.T().Helper()
+
+	generations := make(map[string]int64)
+	it := s.gcsClient.Bucket(s.sampleBucket).Objects(s.ctx, &storage.Query{Prefix: folder + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		s.Require().NoError(err, "must list objects")
+		// the staging folder of the prefix is not part of it.
+		if strings.HasPrefix(attrs.Name, folder+"/.staging/") {
+			continue
+		}
+		generations[attrs.Name] = attrs.Generation
+	}
+
+	return generations
+}
+
+// newPairConfig returns the configuration of the steps on the paths of the
+// sample bucket, with a single thread, reaching the emulator through the
+// storage options of the suite. The options change it further.
+func (s *cmdTestSuite) newPairConfig(opts ...func(*pairConfig)) *pairConfig {
 	cfg := &pairConfig{
 		downscopedToken: "token",
 		threads:         1,
@@ -231,7 +534,17 @@ func (s *cmdTestSuite) requirePrepareForStepTwo() {
 		advTriplePath:   s.advertiserTripleEncryptedGCSFolder(),
 		pubTwicePath:    s.publisherTwiceEncryptedGCSFolder(),
 		pubTriplePath:   s.publisherTripleEncryptedGCSFolder(),
+		storageOptions:  s.storageOptions,
+	}
+	for _, opt := range opts {
+		opt(cfg)
 	}
+
+	return cfg
+}
+
+func (s *cmdTestSuite) requirePrepareForStepTwo() {
+	cfg := s.newPairConfig()
 	err := cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
 	s.Require().NoError(err)
 
@@ -290,17 +603,9 @@ func (s *cmdTestSuite) requirePrepareForStepThree() {
 	})
 	s.Require().NoError(err)
 
-	cfg := &pairConfig{
-		downscopedToken: "token",
-		threads:         1,
-		salt:            s.params.salt,
-		key:             s.params.advertiserKeyConfig.Key,
-		advTwicePath:    s.advertiserTwiceEncryptedGCSFolder(),
-		advTriplePath:   s.advertiserTripleEncryptedGCSFolder(),
-		pubTwicePath:    s.publisherTwiceEncryptedGCSFolder(),
-		pubTriplePath:   s.publisherTripleEncryptedGCSFolder(),
-		cleanroomClient: client,
-	}
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.cleanroomClient = client
+	})
 	err = cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath)
 	s.Require().NoError(err)
 
@@ -310,6 +615,158 @@ func (s *cmdTestSuite) requirePrepareForStepThree() {
 	s.requireGenAdvertiserTripleEncryptedData()
 }
 
+func (s *cmdTestSuite) TestMatch_Tampered() {
+	// arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requireWriteCleanroomHandler(w, s.newCleanroom(v1.Cleanroom_Participant_DATA_TRANSFORMED, v1.Cleanroom_Participant_DATA_TRANSFORMED))
+	}))
+	defer server.Close()
+
+	client, err := internal.NewCleanroomClient(&internal.CleanroomToken{
+		HashSalt:   s.params.salt,
+		Cleanroom:  s.params.cleanroomName,
+		Expiration: 10000,
+		IssuerHost: server.URL,
+	})
+	s.Require().NoError(err)
+
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.cleanroomClient = client
+		c.integrityPath = filepath.Join(s.T().TempDir(), "integrity.json")
+	})
+	s.Require().NoError(cfg.hashEncryt(s.ctx, s.params.advertiserInputFilePath))
+	s.Require().NoError(cfg.reEncrypt(s.ctx, ""))
+	s.requireGenAdvertiserTripleEncryptedData()
+
+	// the untouched data is verified.
+	s.Require().NoError(cfg.match(s.ctx, s.T().TempDir(), ""))
+
+	// act: the publisher swaps the first two rows of the data.
+	name := s.publisherTripleEncryptedFolder() + "/data.csv"
+	r, err := s.gcsClient.Bucket(s.sampleBucket).Object(name).NewReader(s.ctx)
+	s.Require().NoError(err)
+	data, err := io.ReadAll(r)
+	s.Require().NoError(err)
+	s.Require().NoError(r.Close())
+
+	rows := strings.SplitAfter(string(data), "\n")
+	rows[0], rows[1] = rows[1], rows[0]
+	w := s.gcsClient.Bucket(s.sampleBucket).Object(name).NewWriter(s.ctx)
+	_, err = w.Write([]byte(strings.Join(rows, "")))
+	s.Require().NoError(err)
+	s.Require().NoError(w.Close())
+
+	// assert: the data as stored is verified before matching.
+	output := s.T().TempDir()
+	err = cfg.match(s.ctx, output, "")
+	s.Require().ErrorIs(err, ErrTampered)
+	s.Require().Equal(ExitTampered, ExitCode(err))
+
+	entries, err := os.ReadDir(output)
+	s.Require().NoError(err)
+	s.Require().Empty(entries, "must not match tampered data")
+}
+
+func (s *cmdTestSuite) TestMatch_StorageOptions() {
+	// arrange
+	s.requirePrepareForStepThree()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requireWriteCleanroomHandler(w, s.newCleanroom(v1.Cleanroom_Participant_DATA_TRANSFORMED, v1.Cleanroom_Participant_DATA_TRANSFORMED))
+	}))
+	defer server.Close()
+
+	client, err := internal.NewCleanroomClient(&internal.CleanroomToken{
+		HashSalt:   s.params.salt,
+		Cleanroom:  s.params.cleanroomName,
+		Expiration: 10000,
+		IssuerHost: server.URL,
+	})
+	s.Require().NoError(err)
+
+	// the emulator is reached through the endpoint of the options, with a
+	// transport counting the requests.
+
+	transport := &countingTransport{base: http.DefaultTransport}
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.cleanroomClient = client
+		c.storageOptions = []obucket.ClientOption{
+			obucket.WithEndpoint(s.emulatorURL),
+			obucket.WithHTTPClient(&http.Client{Transport: transport}),
+			obucket.WithRetryPolicy(obucket.RetryPolicy{MaxAttempts: 2, Initial: time.Millisecond, Max: time.Second, Multiplier: 2}),
+		}
+	})
+
+	// act
+	err = cfg.match(s.ctx, s.T().TempDir(), "")
+
+	// assert
+	s.Require().NoError(err)
+	s.Require().Positive(transport.requests.Load(), "must send the requests through the HTTP client")
+}
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	base     http.RoundTripper
+	requests atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+func (s *cmdTestSuite) TestVerify() {
+	// arrange
+	s.requirePrepareForStepThree()
+
+	// the publisher completes the paths it writes.
+	for _, folder := range []string{s.publisherTwiceEncryptedFolder(), s.advertiserTripleEncryptedFolder()} {
+		w := s.gcsClient.Bucket(s.sampleBucket).Object(folder + "/" + obucket.CompletedFile).NewWriter(s.ctx)
+		s.Require().NoError(w.Close())
+	}
+
+	paths := []dataPath{
+		{advertiserTwice, s.advertiserTwiceEncryptedGCSFolder()},
+		{publisherTwice, s.publisherTwiceEncryptedGCSFolder()},
+		{advertiserTriple, s.advertiserTripleEncryptedGCSFolder()},
+		{publisherTriple, s.publisherTripleEncryptedGCSFolder()},
+	}
+
+	// the emulator is reached through the endpoint of the storage options of the configuration.
+
+	transport := &countingTransport{base: http.DefaultTransport}
+	cfg := s.newPairConfig(func(c *pairConfig) {
+		c.storageOptions = []obucket.ClientOption{
+			obucket.WithEndpoint(s.emulatorURL),
+			obucket.WithHTTPClient(&http.Client{Transport: transport}),
+		}
+	})
+
+	// act
+	out := &bytes.Buffer{}
+	err := verifyCleanroom(s.ctx, out, cfg, paths)
+
+	// assert
+	s.Require().NoError(err, out.String())
+	s.Require().NotContains(out.String(), "FAIL")
+	s.Require().Positive(transport.requests.Load(), "must send the requests through the HTTP client")
+
+	// a row of the publisher triple encrypted data is not a PAIR ID.
+	w := s.gcsClient.Bucket(s.sampleBucket).Object(s.publisherTripleEncryptedFolder() + "/extra.csv").NewWriter(s.ctx)
+	_, err = w.Write([]byte("not-a-pair-id\n"))
+	s.Require().NoError(err)
+	s.Require().NoError(w.Close())
+
+	out.Reset()
+	err = verifyCleanroom(s.ctx, out, cfg, paths)
+	s.Require().ErrorIs(err, ErrVerificationFailed)
+	s.Require().Equal(ExitVerificationFailed, ExitCode(err))
+	s.Require().Contains(out.String(), "FAIL  1001 of 1002 rows are valid Ristretto255 points")
+	s.Require().Contains(out.String(), "FAIL  1002 rows equal the 1001 rows listed by .Manifest.json")
+	s.Require().Contains(out.String(), "FAIL  publisher triple encrypted rows (1002) equal publisher twice encrypted rows (1001)")
+}
+
 func (s *cmdTestSuite) TestRun_BadToken() {
 	runCommand := RunCmd{
 		Input:            s.params.advertiserInputFilePath,
@@ -543,6 +1000,169 @@ func (s *cmdTestSuite) TestRun_UnspecifiedParticipants() {
 	s.Require().Contains(err.Error(), "role unspecified for participant")
 }
 
+func (s *cmdTestSuite) TestRun_UntilStepOne() {
+	cleanroom := s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	runCommand := s.newRunCmd(server.URL)
+	runCommand.Until = stepOne
+
+	cmdCtx := s.requireNewCmdContext()
+
+	err := runCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+	s.Require().Equal(v1.Cleanroom_Participant_DATA_CONTRIBUTED, cleanroom.Participants[1].State, "must stop after step one")
+	s.Require().NoDirExists(s.params.advertiserOutputFolderPath, "must not match")
+
+	// running again is a no-op since step one is done
+	err = runCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+	s.Require().Equal(v1.Cleanroom_Participant_DATA_CONTRIBUTED, cleanroom.Participants[1].State, "must not run step two")
+}
+
+func (s *cmdTestSuite) TestSteps() {
+	cleanroom := s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	token := s.requireGenerateToken(server.URL, s.params.cleanroomName, s.params.salt)
+	cmdCtx := s.requireNewCmdContext()
+
+	// steps can not run out of order
+	reEncryptCommand := ReEncryptCmd{
+		PairCleanroomToken: token,
+		NumThreads:         1,
+		PublisherPAIRIDs:   s.params.publisherPAIRIDsFolderPath,
+	}
+	err := reEncryptCommand.Run(cmdCtx)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "cannot re-encrypt publisher data")
+
+	encryptCommand := EncryptCmd{
+		PairCleanroomToken: token,
+		Input:              s.params.advertiserInputFilePath,
+		NumThreads:         1,
+	}
+	err = encryptCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+	s.Require().Equal(v1.Cleanroom_Participant_DATA_CONTRIBUTED, cleanroom.Participants[1].State)
+
+	err = reEncryptCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+	s.Require().Equal(v1.Cleanroom_Participant_DATA_TRANSFORMED, cleanroom.Participants[1].State)
+
+	matchCommand := MatchCmd{
+		PairCleanroomToken: token,
+		NumThreads:         1,
+		Output:             s.params.advertiserOutputFolderPath,
+		PublisherPAIRIDs:   s.params.publisherPAIRIDsFolderPath,
+	}
+	err = matchCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+
+	// check the result
+	s.requireLocalContentEqualToGCSContent(s.params.advertiserOutputFolderPath, s.publisherTwiceEncryptedFolder())
+	s.requireLocalContentEqualToGCSContent(s.params.publisherPAIRIDsFolderPath, s.publisherTripleEncryptedFolder())
+}
+
+func (s *cmdTestSuite) TestRun_Plan() {
+	cleanroom := s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	runCommand := s.newRunCmd(server.URL)
+	runCommand.Plan = true
+
+	cmdCtx := s.requireNewCmdContext()
+
+	err := runCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+	s.Require().Equal(v1.Cleanroom_Participant_INVITED, cleanroom.Participants[1].State, "must not advance the state")
+
+	objects, err := obucket.ListObjects(s.ctx, s.storageClient, s.advertiserTwiceEncryptedGCSFolder())
+	s.Require().NoError(err)
+	s.Require().Empty(objects, "must not upload anything")
+
+	pairCfg, err := newPAIRConfigFromCLI(cmdCtx, runCommand.PairCleanroomToken, 1)
+	s.Require().NoError(err)
+
+	plan := &bytes.Buffer{}
+	err = runCommand.writePlan(s.ctx, plan, pairCfg, v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	s.Require().NoError(err)
+	s.Require().Contains(plan.String(), fmt.Sprintf("%s (%d rows)", s.params.advertiserInputFilePath, genEmailsSourceNumber))
+	s.Require().Contains(plan.String(), fmt.Sprintf("gs://%s/%s", s.sampleBucket, s.publisherTwiceEncryptedDataFile()))
+	s.Require().Contains(plan.String(), fmt.Sprintf("%s/.staging/data_<random>.csv", s.advertiserTwiceEncryptedGCSFolder()))
+	s.Require().Contains(plan.String(), fmt.Sprintf("%s/%s", s.advertiserTwiceEncryptedGCSFolder(), obucket.ManifestFile))
+	s.Require().Contains(plan.String(), "advertiser state INVITED -> DATA_CONTRIBUTED")
+	s.Require().Contains(plan.String(), "advertiser state DATA_CONTRIBUTED -> DATA_TRANSFORMED")
+	s.Require().Contains(plan.String(), "result_<n>.csv")
+}
+
+func (s *cmdTestSuite) TestRun_Report() {
+	cleanroom := s.newCleanroom(v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_INVITED)
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	reportPath := path.Join(s.tmpDir, "report.json")
+	runCommand := s.newRunCmd(server.URL)
+	runCommand.Report = reportPath
+
+	err := runCommand.Run(s.requireNewCmdContext())
+	s.Require().NoError(err)
+
+	data, err := os.ReadFile(reportPath)
+	s.Require().NoError(err, "must write report")
+
+	report := &runReport{}
+	err = json.Unmarshal(data, report)
+	s.Require().NoError(err, "must unmarshal report")
+
+	s.Require().Equal(s.params.cleanroomName, report.Cleanroom)
+	s.Require().Equal(s.params.advertiserKeyConfig.ID, report.KeyID)
+	s.Require().Empty(report.Error)
+	s.Require().Len(report.Steps, 3)
+
+	for i, step := range []string{stepOne, stepTwo, stepThree} {
+		s.Require().Equal(step, report.Steps[i].Step)
+		s.Require().Equal(stepExecuted, report.Steps[i].Status)
+		s.Require().NotEmpty(report.Steps[i].ReadObjects)
+		s.Require().NotEmpty(report.Steps[i].WrittenObjects)
+	}
+
+	s.Require().EqualValues(genEmailsSourceNumber, report.Steps[0].Read)
+	s.Require().EqualValues(genEmailsSourceNumber, report.Steps[0].Written)
+	s.Require().EqualValues(genEmailsSourceNumber, report.Steps[1].Read)
+	s.Require().EqualValues(genEmailsSourceNumber, report.Steps[1].Written)
+
+	s.Require().NotNil(report.Match)
+	s.Require().EqualValues(genEmailsSourceNumber, report.Match.Matched)
+	s.Require().InDelta(100, report.Match.MatchRate, 0.001)
+}
+
+// newRunCmd returns the run command of the clean room served by the server at
+// serverURL, with a single thread.
+func (s *cmdTestSuite) newRunCmd(serverURL string) RunCmd {
+	return RunCmd{
+		PairCleanroomToken: s.requireGenerateToken(serverURL, s.params.cleanroomName, s.params.salt),
+		Input:              s.params.advertiserInputFilePath,
+		NumThreads:         1,
+		Output:             s.params.advertiserOutputFolderPath,
+	}
+}
+
+func (s *cmdTestSuite) requireNewCmdContext() *CmdContext {
+	cli := Cli{Context: keyContext}
+	cfg := &Config{
+		configPath: s.params.advertiserKeyConfigFilePath,
+	}
+
+	cmdCtx, err := cli.NewContext(cfg)
+	s.Require().NoError(err)
+
+	return cmdCtx
+}
+
 func (s *cmdTestSuite) requireWriteCleanroomHandler(w http.ResponseWriter, cleanroom *v1.Cleanroom) {
 	w.WriteHeader(http.StatusOK)
 	data, err := proto.Marshal(cleanroom)
@@ -552,6 +1172,42 @@ func (s *cmdTestSuite) requireWriteCleanroomHandler(w http.ResponseWriter, clean
 }
 
 func (s *cmdTestSuite) testRun(workersNum int, cleanroom *v1.Cleanroom) {
+	server := s.newAdvancingServer(cleanroom)
+	defer server.Close()
+
+	runCommand := RunCmd{
+		PairCleanroomToken: s.requireGenerateToken(server.URL, s.params.cleanroomName, s.params.salt),
+		Input:              s.params.advertiserInputFilePath,
+		NumThreads:         workersNum,
+		Output:             s.params.advertiserOutputFolderPath,
+		PublisherPAIRIDs:   s.params.publisherPAIRIDsFolderPath,
+	}
+
+	cli := Cli{
+		CleanroomCmd: CleanroomCmd{
+			Run: runCommand,
+		},
+		Context: keyContext,
+	}
+
+	cfg := &Config{
+		configPath: s.params.advertiserKeyConfigFilePath,
+	}
+
+	cmdCtx, err := cli.NewContext(cfg)
+	s.Require().NoError(err)
+
+	err = runCommand.Run(cmdCtx)
+	s.Require().NoError(err)
+
+	// check the result
+	s.requireLocalContentEqualToGCSContent(s.params.advertiserOutputFolderPath, s.publisherTwiceEncryptedFolder())
+	s.requireLocalContentEqualToGCSContent(s.params.publisherPAIRIDsFolderPath, s.publisherTripleEncryptedFolder())
+}
+
+// newAdvancingServer creates a mock optable server which advances the state of
+// both participants each time the advertiser advances its state.
+func (s *cmdTestSuite) newAdvancingServer(cleanroom *v1.Cleanroom) *httptest.Server {
 	// next states for the participants to advance the cleanroom
 	nextState, stateExists := map[v1.Cleanroom_Participant_State]v1.Cleanroom_Participant_State{
 		v1.Cleanroom_Participant_INVITED:          v1.Cleanroom_Participant_DATA_CONTRIBUTED,
@@ -561,7 +1217,7 @@ func (s *cmdTestSuite) testRun(workersNum int, cleanroom *v1.Cleanroom) {
 	}, false
 
 	// init optable mock server
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case internal.AdminCleanroomRefreshTokenURL, internal.AdminCleanroomGetURL:
 			s.requireWriteCleanroomHandler(w, cleanroom)
@@ -587,36 +1243,6 @@ func (s *cmdTestSuite) testRun(workersNum int, cleanroom *v1.Cleanroom) {
 			s.T().Errorf("Unexpected call %s", r.URL.Path)
 		}
 	}))
-	defer server.Close()
-
-	runCommand := RunCmd{
-		PairCleanroomToken: s.requireGenerateToken(server.URL, s.params.cleanroomName, s.params.salt),
-		Input:              s.params.advertiserInputFilePath,
-		NumThreads:         workersNum,
-		Output:             s.params.advertiserOutputFolderPath,
-		PublisherPAIRIDs:   s.params.publisherPAIRIDsFolderPath,
-	}
-
-	cli := Cli{
-		CleanroomCmd: CleanroomCmd{
-			Run: runCommand,
-		},
-		Context: keyContext,
-	}
-
-	cfg := &Config{
-		configPath: s.params.advertiserKeyConfigFilePath,
-	}
-
-	cmdCtx, err := cli.NewContext(cfg)
-	s.Require().NoError(err)
-
-	err = runCommand.Run(cmdCtx)
-	s.Require().NoError(err)
-
-	// check the result
-	s.requireLocalContentEqualToGCSContent(s.params.advertiserOutputFolderPath, s.publisherTwiceEncryptedFolder())
-	s.requireLocalContentEqualToGCSContent(s.params.publisherPAIRIDsFolderPath, s.publisherTripleEncryptedFolder())
 }
 
 // creates new cleanroom with the given name and expire time
@@ -728,16 +1354,32 @@ func (s *cmdTestSuite) requireGenPublisherTwiceEncryptedData() {
 	}
 }
 
+// requireGenPublisherTwiceEncryptedShard writes another object of publisher
+// twice encrypted data, with identifiers distinct from the other objects.
+func (s *cmdTestSuite) requireGenPublisherTwiceEncryptedShard(shard int) {
+	s.T().Helper()
+
+	w := s.gcsClient.Bucket(s.sampleBucket).Object(
+		fmt.Sprintf("%s/shard_%d.csv", s.publisherTwiceEncryptedFolder(), shard),
+	).NewWriter(s.ctx)
+
+	csvWriter := csv.NewWriter(w)
+	for i := range genEmailsSourceNumber {
+		hem := sha256.Sum256([]byte(fmt.Sprintf("shard-%d-%d@example.com", shard, i)))
+		twiceEnc, err := s.params.publisherPairKey.Encrypt([]byte(fmt.Sprintf("%x", hem)))
+		s.Require().NoError(err, "must encrypt email")
+		err = csvWriter.Write([]string{string(twiceEnc)})
+		s.Require().NoError(err, "must write email")
+	}
+	csvWriter.Flush()
+	s.Require().NoError(csvWriter.Error(), "must flush writer")
+	s.Require().NoError(w.Close(), "must close GCS writer")
+}
+
 func (s *cmdTestSuite) requireGenAdvertiserTripleEncryptedData() {
 	s.T().Helper()
 
-	readClosers, err := obucket.ReadersFromPrefixedBucket(s.ctx, s.gcsClient,
-		&obucket.PrefixedBucket{
-			Bucket: s.sampleBucket,
-			Prefix: s.advertiserTwiceEncryptedFolder(),
-		},
-	)
-	s.Require().NoError(err, "must create readers")
+	readClosers := s.requireReadersFromFolder(s.advertiserTwiceEncryptedFolder())
 	s.Require().NotEmpty(readClosers, "must have twice encrypted data")
 
 	readers := make([]io.Reader, len(readClosers))
@@ -811,11 +1453,7 @@ func (s *cmdTestSuite) requireLocalContentEqualToGCSContent(localFolder, gcsFold
 		localValuesMap[record[0]] = struct{}{}
 	}
 
-	readClosers, err := obucket.ReadersFromPrefixedBucket(s.ctx, s.gcsClient, &obucket.PrefixedBucket{
-		Bucket: s.sampleBucket,
-		Prefix: gcsFolder,
-	})
-	s.Require().NoError(err, "must create readers")
+	readClosers := s.requireReadersFromFolder(gcsFolder)
 	s.Require().NotEmpty(readClosers, "must have twice encrypted data")
 
 	readers := make([]io.Reader, len(readClosers))
@@ -898,3 +1536,18 @@ func (s *cmdTestSuite) publisherTwiceEncryptedDataFile() string {
 func (s *cmdTestSuite) advertiserTripleEncryptedFile() string {
 	return s.advertiserTripleEncryptedFolder() + "/data.csv"
 }
+
+// requireReadersFromFolder opens a reader for each data object of the folder of the sample bucket.
+func (s *cmdTestSuite) requireReadersFromFolder(folder string) []io.ReadCloser {
+	s.T().Helper()
+
+	pBucket := &obucket.PrefixedBucket{
+		Scheme: "gs",
+		Bucket: s.sampleBucket,
+		Prefix: folder,
+	}
+	readClosers, err := obucket.ReadersFromPrefixedBucket(s.ctx, s.storageClient, pBucket)
+	s.Require().NoError(err, "must create readers")
+
+	return readClosers
+}
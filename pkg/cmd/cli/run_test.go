@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"optable-pair-cli/pkg/internal"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWaitProgress(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	logger := zerolog.New(out)
+	progress := &waitProgress{logger: &logger, interval: time.Hour}
+
+	// the first observation is logged right away, the next ones are throttled.
+	progress.observe(v1.Cleanroom_Participant_INVITED, 0)
+	progress.observe(v1.Cleanroom_Participant_DATA_CONTRIBUTING, 2*time.Second)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0], `"publisher_state":"INVITED"`)
+	require.Contains(t, lines[0], `"elapsed":"0s"`)
+
+	// once the interval is over, the current state is logged again.
+	progress.interval = 0
+	progress.observe(v1.Cleanroom_Participant_DATA_CONTRIBUTING, 2*time.Second)
+
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[1], `"publisher_state":"DATA_CONTRIBUTING"`)
+	require.Contains(t, lines[1], `"elapsed":"2s"`)
+}
+
+func TestWaitForPublisher_Timeouts(t *testing.T) {
+	t.Parallel()
+
+	// the publisher never contributes its data.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		data, err := proto.Marshal(&v1.Cleanroom{
+			Participants: []*v1.Cleanroom_Participant{
+				{Role: v1.Cleanroom_Participant_PUBLISHER, State: v1.Cleanroom_Participant_INVITED},
+			},
+		})
+		if err != nil {
+			t.Errorf("failed to marshal response: %v", err)
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	newClient := func(pollTimeout time.Duration) *internal.CleanroomClient {
+		policy := internal.DefaultPollPolicy()
+		policy.Interval = 10 * time.Millisecond
+		policy.Timeout = pollTimeout
+		client, err := internal.NewCleanroomClient(&internal.CleanroomToken{
+			Cleanroom:  "cleanrooms/test",
+			Expiration: 10000,
+			IssuerHost: server.URL,
+		}, internal.WithPollPolicy(policy))
+		require.NoError(t, err)
+
+		return client
+	}
+
+	t.Run("wait timeout replaces a longer poll timeout", func(t *testing.T) {
+		t.Parallel()
+
+		err := waitForPublisher(context.Background(), newClient(time.Hour), 100*time.Millisecond)
+		require.ErrorIs(t, err, internal.ErrWaitTimeout)
+		require.ErrorContains(t, err, "after 100ms")
+	})
+
+	t.Run("wait timeout replaces a shorter poll timeout", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+
+		// the poll timeout would expire first if it applied.
+		err := waitForPublisher(ctx, newClient(50*time.Millisecond), time.Hour)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, internal.ErrWaitTimeout)
+	})
+}
@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables overriding the flags, e.g. OPAIR_NUM_THREADS.
+	EnvPrefix = "OPAIR"
+	// EnvSettingsFile overrides the path of the settings file.
+	EnvSettingsFile = EnvPrefix + "_CONFIG"
+
+	defaultProfile = "default"
+	profileFlag    = "profile"
+)
+
+var ErrUnknownSetting = errors.New("unknown setting")
+
+type (
+	// Settings is the opair configuration file. Each profile sets the default
+	// values of flags by name, e.g. num-threads or log-format. The values are
+	// resolved with the following precedence: command-line flags, OPAIR_*
+	// environment variables, the selected profile, and the built-in defaults.
+	Settings struct {
+		CurrentProfile string             `yaml:"current-profile,omitempty"`
+		Profiles       map[string]Profile `yaml:"profiles,omitempty"`
+
+		path string
+	}
+
+	// Profile maps flag names to their values.
+	Profile map[string]string
+
+	ConfigCmd struct {
+		Get  ConfigGetCmd  `cmd:"" help:"Print the value of a setting of the profile."`
+		Set  ConfigSetCmd  `cmd:"" help:"Set the value of a setting of the profile."`
+		View ConfigViewCmd `cmd:"" help:"Print the configuration file."`
+	}
+
+	ConfigGetCmd struct {
+		Key string `arg:"" help:"The name of the setting, which is the name of the flag it sets, e.g. num-threads."`
+	}
+
+	ConfigSetCmd struct {
+		Key   string `arg:"" help:"The name of the setting, which is the name of the flag it sets, e.g. num-threads."`
+		Value string `arg:"" help:"The value of the setting."`
+	}
+
+	ConfigViewCmd struct{}
+)
+
+// SettingsPath returns the path of the settings file: the value of the
+// OPAIR_CONFIG environment variable, or the default path given by the caller.
+func SettingsPath(defaultPath string) string {
+	if path := os.Getenv(EnvSettingsFile); path != "" {
+		return path
+	}
+
+	return defaultPath
+}
+
+// LoadSettings reads the settings file at the given path. A missing file yields empty settings.
+func LoadSettings(path string) (*Settings, error) {
+	settings := &Settings{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return settings, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("malformed configuration file %s: %w", path, err)
+	}
+
+	return settings, nil
+}
+
+// Save writes the settings to their file.
+func (s *Settings) Save() error {
+	// 0700: rwx------, the settings may point to the advertiser keys.
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	data, err := s.marshal()
+	if err != nil {
+		return err
+	}
+
+	// 0600: rw-------
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Settings) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(s); err != nil {
+		return nil, fmt.Errorf("yaml.Encode: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// profileName returns the name of the selected profile: the one given by
+// --profile or OPAIR_PROFILE, else the current profile of the file, else default.
+func (s *Settings) profileName(selected string) string {
+	if selected != "" {
+		return selected
+	}
+
+	if s.CurrentProfile != "" {
+		return s.CurrentProfile
+	}
+
+	return defaultProfile
+}
+
+// Resolve resolves the flags that are not set on the command line nor by their
+// environment variables from the selected profile.
+func (s *Settings) Resolve(kctx *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+	if flag.Name == profileFlag {
+		return nil, nil
+	}
+
+	// environment variables take precedence over the profile, but kong applies
+	// them as defaults, before the resolvers.
+	for _, env := range flag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return nil, nil
+		}
+	}
+
+	profile := s.Profiles[s.profileName(selectedProfile(kctx))]
+	if value, ok := profile[flag.Name]; ok {
+		return value, nil
+	}
+
+	return nil, nil
+}
+
+// Validate checks that the profiles only set existing flags.
+func (s *Settings) Validate(app *kong.Application) error {
+	flags := flagNames(app.Node)
+	for name, profile := range s.Profiles {
+		for key := range profile {
+			if !slices.Contains(flags, key) {
+				return fmt.Errorf("%w %q in profile %q of %s", ErrUnknownSetting, key, name, s.path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectedProfile returns the value of the --profile flag.
+func selectedProfile(kctx *kong.Context) string {
+	for _, flag := range kctx.Flags() {
+		if flag.Name == profileFlag {
+			if profile, ok := kctx.FlagValue(flag).(string); ok {
+				return profile
+			}
+		}
+	}
+
+	return ""
+}
+
+// flagNames returns the names of the flags of the node and its descendants.
+func flagNames(node *kong.Node) []string {
+	var names []string
+	for _, flag := range node.Flags {
+		if flag.Name != profileFlag {
+			names = append(names, flag.Name)
+		}
+	}
+
+	for _, child := range node.Children {
+		names = append(names, flagNames(child)...)
+	}
+
+	return names
+}
+
+func (c *ConfigGetCmd) Run(cli *CmdContext, settings *Settings) error {
+	profile := settings.profileName(cli.profile)
+	value, ok := settings.Profiles[profile][c.Key]
+	if !ok {
+		return fmt.Errorf("%s is not set in profile %q", c.Key, profile)
+	}
+
+	fmt.Println(value)
+	return nil
+}
+
+func (c *ConfigSetCmd) Run(cli *CmdContext, settings *Settings, kctx *kong.Context) error {
+	if !slices.Contains(flagNames(kctx.Model.Node), c.Key) {
+		return fmt.Errorf("%w %q, settings are named after the flags they set", ErrUnknownSetting, c.Key)
+	}
+
+	profile := settings.profileName(cli.profile)
+	if settings.Profiles == nil {
+		settings.Profiles = map[string]Profile{}
+	}
+	if settings.Profiles[profile] == nil {
+		settings.Profiles[profile] = Profile{}
+	}
+	settings.Profiles[profile][c.Key] = c.Value
+
+	if err := settings.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Set %s=%s in profile %q of %s\n", c.Key, c.Value, profile, settings.path)
+	return nil
+}
+
+func (c *ConfigViewCmd) Run(cli *CmdContext, settings *Settings) error {
+	data, err := settings.marshal()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("# %s, profile in use: %s\n", settings.path, settings.profileName(cli.profile))
+	fmt.Print(strings.TrimPrefix(string(data), "{}\n"))
+	return nil
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettings_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	settings, err := LoadSettings(path)
+	require.NoError(t, err)
+
+	settings.CurrentProfile = "ci"
+	settings.Profiles = map[string]Profile{
+		"ci": {
+			"num-threads":   "3",
+			"log-format":    "json",
+			"poll-interval": "5s",
+			"progress":      "log",
+		},
+		"local": {
+			"num-threads": "5",
+		},
+	}
+	require.NoError(t, settings.Save())
+
+	settings, err = LoadSettings(path)
+	require.NoError(t, err)
+
+	t.Setenv("OPAIR_PROGRESS", "none")
+
+	c := requireParse(t, settings, "cleanroom", "run", "token", "--poll-interval", "2s")
+	require.Equal(t, 3, c.CleanroomCmd.Run.NumThreads, "set by the current profile")
+	require.Equal(t, "json", c.Log.Format, "set by the current profile")
+	require.Equal(t, 2*time.Second, c.Poll.Interval, "the command line overrides the profile")
+	require.Equal(t, "none", c.Progress, "the environment overrides the profile")
+	require.Equal(t, time.Minute, c.Poll.MaxInterval, "not set by the profile")
+
+	c = requireParse(t, settings, "--profile", "local", "cleanroom", "run", "token")
+	require.Equal(t, 5, c.CleanroomCmd.Run.NumThreads, "set by the selected profile")
+	require.Equal(t, "console", c.Log.Format, "not set by the selected profile")
+}
+
+func TestSettings_UnknownSetting(t *testing.T) {
+	t.Parallel()
+
+	settings := &Settings{
+		Profiles: map[string]Profile{
+			defaultProfile: {"num-thread": "3"},
+		},
+	}
+
+	parser, err := kong.New(&Cli{}, kong.Resolvers(settings))
+	require.NoError(t, err)
+
+	_, err = parser.Parse([]string{"version"})
+	require.ErrorIs(t, err, ErrUnknownSetting)
+}
+
+func requireParse(t *testing.T, settings *Settings, args ...string) *Cli {
+	t.Helper()
+
+	c := &Cli{}
+	parser, err := kong.New(c, kong.DefaultEnvars(EnvPrefix), kong.Resolvers(settings))
+	require.NoError(t, err)
+
+	_, err = parser.Parse(args)
+	require.NoError(t, err)
+
+	return c
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+)
+
+// notifyInterrupt cancels the context of the command on the first SIGINT or
+// SIGTERM, with ErrInterrupted as cause. The steps then abort their uploads
+// instead of committing partial objects, and skip the .Completed markers.
+// The default behavior is restored once a signal is received, so a second
+// one terminates opair immediately.
+func (c *CmdContext) notifyInterrupt() {
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	c.ctx = ctx
+	c.interrupt = func(sig os.Signal) {
+		cancel(fmt.Errorf("%w by %s", ErrInterrupted, sig))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			zerolog.Ctx(ctx).Warn().Msgf("received %s, aborting: send it again to exit immediately", sig)
+			c.interrupt(sig)
+		case <-ctx.Done():
+		}
+	}()
+
+	c.closers = append(c.closers, func() {
+		signal.Stop(signals)
+		cancel(nil)
+	})
+}
+
+// Interrupted marks the error of an interrupted command with ErrInterrupted,
+// since the steps may fail with any error once their context is cancelled.
+func (c *CmdContext) Interrupted(err error) error {
+	cause := context.Cause(c.ctx)
+	if err == nil || !errors.Is(cause, ErrInterrupted) || errors.Is(err, ErrInterrupted) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", cause, err)
+}
+
+// resumeTokenArg replaces the clean room token in the resume command, so that
+// the command is logged without the token and can be run as printed once the
+// token is exported.
+const resumeTokenArg = `"$OPAIR_PAIR_CLEANROOM_TOKEN"`
+
+// LogResumeCommand logs the command resuming an interrupted run: the same
+// command, since the steps left incomplete are run again and the completed
+// ones are skipped. args are the command line arguments, os.Args.
+func (c *CmdContext) LogResumeCommand(err error, args []string) {
+	if !c.resumable || !errors.Is(err, ErrInterrupted) {
+		return
+	}
+
+	c.Log().Warn().
+		Str("resume_command", resumeCommand(args, c.cleanroomToken)).
+		Msg("opair was interrupted before completing, no partial data was committed: export your clean room token as OPAIR_PAIR_CLEANROOM_TOKEN and run the resume command to resume")
+}
+
+// resumeCommand joins the arguments into a command line, quoting them for POSIX
+// shells when needed, and referring to the clean room token through the
+// OPAIR_PAIR_CLEANROOM_TOKEN environment variable.
+func resumeCommand(args []string, token string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if token != "" && arg == token {
+			quoted[i] = resumeTokenArg
+			continue
+		}
+		quoted[i] = shellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+
+	safe := strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@%+", r))
+	}) < 0
+	if safe {
+		return arg
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeCommand(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t,
+		`opair cleanroom run "$OPAIR_PAIR_CLEANROOM_TOKEN" -i ./input.csv -o 'my output' --until=step1 'it'\''s' ''`,
+		resumeCommand([]string{"opair", "cleanroom", "run", "token", "-i", "./input.csv", "-o", "my output", "--until=step1", "it's", ""}, "token"),
+	)
+}
+
+func TestResumeCommand_Runnable(t *testing.T) {
+	t.Parallel()
+
+	args := []string{"opair", "cleanroom", "run", "a.token-with/chars=", "-o", "out dir", "--until=step1", "it's", "$HOME"}
+	command := resumeCommand(args, "a.token-with/chars=")
+	require.NotContains(t, command, "a.token-with/chars=")
+
+	// the shell expands the command back to the original arguments once the token is exported.
+	cmd := exec.Command("sh", "-c", `printargs() { for arg; do printf '%s\n' "$arg"; done; }; printargs `+command)
+	cmd.Env = append(os.Environ(), "OPAIR_PAIR_CLEANROOM_TOKEN=a.token-with/chars=")
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, args, strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"))
+}
+
+func TestInterrupted(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	redactor := newRedactingWriter(&buf)
+	redactor.add("supersecrettoken")
+
+	cmdCtx := &CmdContext{
+		ctx:            newLogger("opair", 0, redactor).WithContext(context.Background()),
+		redactor:       redactor,
+		resumable:      true,
+		cleanroomToken: "supersecrettoken",
+	}
+	cmdCtx.notifyInterrupt()
+	defer cmdCtx.Close()
+
+	// errors are left untouched until interrupted
+	err := errors.New("boom")
+	require.Equal(t, err, cmdCtx.Interrupted(err))
+
+	cmdCtx.interrupt(syscall.SIGTERM)
+	<-cmdCtx.Context().Done()
+
+	err = cmdCtx.Interrupted(context.Canceled)
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, ExitInterrupted, ExitCode(err))
+	require.Equal(t, "interrupted", ErrorCode(err))
+	require.Equal(t, err, cmdCtx.Interrupted(err), "must mark the error once")
+
+	buf.Reset()
+	cmdCtx.LogResumeCommand(err, []string{"opair", "cleanroom", "run", "supersecrettoken", "-o", "out dir"})
+
+	var event map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	require.Equal(t, `opair cleanroom run "$OPAIR_PAIR_CLEANROOM_TOKEN" -o 'out dir'`, event["resume_command"])
+}
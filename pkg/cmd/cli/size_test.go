@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteSize(t *testing.T) {
+	t.Parallel()
+
+	for text, expected := range map[string]byteSize{
+		"1024":    1024,
+		"100B":    100,
+		"512MiB":  512 << 20,
+		"512m":    512 << 20,
+		"1GB":     1e9,
+		"1.5 GiB": 3 << 29,
+		"2TiB":    2 << 40,
+		"64kb":    64e3,
+	} {
+		var s byteSize
+		require.NoError(t, s.UnmarshalText([]byte(text)), text)
+		require.Equal(t, expected, s, text)
+	}
+
+	for _, text := range []string{"", "MiB", "-1GB", "1XB", "one"} {
+		var s byteSize
+		require.Error(t, s.UnmarshalText([]byte(text)), text)
+	}
+}
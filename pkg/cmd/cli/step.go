@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+)
+
+// Names of the PAIR steps, as shown to the user.
+const (
+	stepOneName   = "encrypt advertiser data"
+	stepTwoName   = "re-encrypt publisher data"
+	stepThreeName = "match"
+)
+
+// Compressions of the objects written by the steps, set by the --compression flag.
+const (
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+type (
+	EncryptCmd struct {
+		PairCleanroomToken string   `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+		Input              string   `cmd:"" short:"i" help:"The path to the input file containing the newline separated list of canonicalized email addresses for encrypted PAIR matching. If a directory path is provided, all files within the directory will be processed."`
+		NumThreads         int      `cmd:"" short:"n" help:"The number of threads to use for the operation. Defaults to the number of the available cores on the machine."`
+		ShardRows          int64    `cmd:"" help:"Upload the encrypted advertiser data as numbered objects of at most the given number of rows, uploaded concurrently, up to --num-threads at a time. A single object is uploaded by default."`
+		ShardSize          byteSize `cmd:"" help:"Upload the encrypted advertiser data as numbered objects of about the given size, e.g. 512MiB, uploaded concurrently, up to --num-threads at a time. A single object is uploaded by default."`
+		Compression        string   `cmd:"" enum:"gzip,none" default:"none" help:"Compress the encrypted advertiser data with gzip before uploading it, to reduce egress. Only use gzip when the clean room reads compressed data. Valid options: [gzip,none]"`
+	}
+
+	ReEncryptCmd struct {
+		PairCleanroomToken string `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+		NumThreads         int    `cmd:"" short:"n" help:"The number of threads to use for the operation. Defaults to the number of the available cores on the machine."`
+		PublisherPAIRIDs   string `cmd:"" name:"save-publisher-encrypted-data-locally" short:"s" help:"Save a local copy of the triple encrypted publisher dataset to the given directory. See the help of the run command for details."`
+		Compression        string `cmd:"" enum:"gzip,none" default:"none" help:"Compress the re-encrypted publisher data with gzip before uploading it, to reduce egress. Only use gzip when the clean room reads compressed data. Valid options: [gzip,none]"`
+	}
+
+	MatchCmd struct {
+		PairCleanroomToken string `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+		NumThreads         int    `cmd:"" short:"n" help:"The number of threads to use for the operation. Defaults to the number of the available cores on the machine."`
+		Output             string `cmd:"" short:"o" required:"" help:"The path to the output directory to write the intersected publisher PAIR IDs to."`
+		PublisherPAIRIDs   string `cmd:"" name:"save-publisher-encrypted-data-locally" short:"s" help:"Use the local copy of the triple encrypted publisher dataset saved by a previous reencrypt or run command with the -s flag."`
+	}
+)
+
+func (c *EncryptCmd) Help() string {
+	return `
+Run step 1 of the PAIR protocol only: hash and encrypt the advertiser data
+with the advertiser clean room's private key, send it to the clean room and
+advance the advertiser state to DATA_CONTRIBUTED. The publisher must have
+contributed its data and the advertiser must not have contributed yet.
+`
+}
+
+func (c *ReEncryptCmd) Help() string {
+	return `
+Run step 2 of the PAIR protocol only: re-encrypt the publisher's hashed and
+encrypted PAIR IDs with the advertiser clean room's private key, send them
+to the clean room and advance the advertiser state to DATA_TRANSFORMED. The
+advertiser data must have been contributed with the` + " `encrypt` " + `or` + " `run` " + `command.
+`
+}
+
+func (c *MatchCmd) Help() string {
+	return `
+Run step 3 of the PAIR protocol only: wait for the publisher to re-encrypt the
+advertiser data, then match the two sets of triple encrypted PAIR IDs and
+write the decrypted publisher PAIR IDs of the intersection to the output
+directory. The publisher data must have been re-encrypted with the` + " `reencrypt` " + `
+or` + " `run` " + `command.
+`
+}
+
+func (c *EncryptCmd) Run(cli *CmdContext) error {
+	ctx := cli.Context()
+
+	pairCfg, err := newPAIRConfigFromCLI(cli, c.PairCleanroomToken, c.NumThreads)
+	if err != nil {
+		return err
+	}
+
+	if err := pairCfg.requireAction(ctx, stepOneName, func(a *action) bool { return a.contributeAdvertiserData }); err != nil {
+		return err
+	}
+	pairCfg.shardRows, pairCfg.shardSize = c.ShardRows, int64(c.ShardSize)
+	pairCfg.compression = c.Compression
+
+	return runStepOne(ctx, pairCfg, c.Input)
+}
+
+func (c *ReEncryptCmd) Run(cli *CmdContext) error {
+	ctx := cli.Context()
+
+	pairCfg, err := newPAIRConfigFromCLI(cli, c.PairCleanroomToken, c.NumThreads)
+	if err != nil {
+		return err
+	}
+
+	if err := pairCfg.requireAction(ctx, stepTwoName, func(a *action) bool { return a.reEncryptPublisherData }); err != nil {
+		return err
+	}
+	pairCfg.compression = c.Compression
+
+	return runStepTwo(ctx, pairCfg, c.PublisherPAIRIDs)
+}
+
+func (c *MatchCmd) Run(cli *CmdContext) error {
+	ctx := cli.Context()
+
+	pairCfg, err := newPAIRConfigFromCLI(cli, c.PairCleanroomToken, c.NumThreads)
+	if err != nil {
+		return err
+	}
+
+	if err := pairCfg.requireAction(ctx, stepThreeName, func(a *action) bool { return a.matchData }); err != nil {
+		return err
+	}
+
+	return pairCfg.match(ctx, c.Output, c.PublisherPAIRIDs)
+}
+
+// requireAction checks that the current state of the clean room allows to run the given step.
+func (c *pairConfig) requireAction(ctx context.Context, step string, allowed func(*action) bool) error {
+	publisherState, advertiserState, err := c.participantStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	action, err := actionFromStates(publisherState, advertiserState)
+	if err != nil {
+		return err
+	}
+
+	if !allowed(action) {
+		return fmt.Errorf("%w: cannot %s with advertiser state: %s and publisher state: %s", ErrInvalidState, step, advertiserState, publisherState)
+	}
+
+	return nil
+}
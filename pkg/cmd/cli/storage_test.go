@@ -0,0 +1,549 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/internal"
+	"optable-pair-cli/pkg/keys"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestPAIR_FileBucket runs the steps 1 and 2 against file:// URLs, with no
+// storage emulator: the advertiser twice encrypted data written by step 1 is
+// re-encrypted by step 2 as if shipped by the publisher, both steps with the
+// same compression.
+func TestPAIR_FileBucket(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		compression string
+		suffix      string
+	}{
+		{compression: compressionNone, suffix: ".csv"},
+		{compression: compressionGzip, suffix: ".csv.gz"},
+	} {
+		t.Run(tc.compression, func(t *testing.T) {
+			t.Parallel()
+			testPAIRFileBucket(t, tc.compression, tc.suffix)
+		})
+	}
+}
+
+func testPAIRFileBucket(t *testing.T, compression, suffix string) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var input strings.Builder
+	for i := range 1001 {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	twicePath := "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+	triplePath := "file://" + filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		threads:         2,
+		compression:     compression,
+		salt:            base64.StdEncoding.EncodeToString(salt),
+		key:             keyConfig.Key,
+		advTwicePath:    twicePath,
+		pubTwicePath:    twicePath,
+		pubTriplePath:   triplePath,
+		integrityPath:   filepath.Join(dir, "integrity.json"),
+	}
+
+	client, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// step 1 stages and promotes the data, and writes a manifest.
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+
+	objects, err := bucket.ListObjects(ctx, client, twicePath)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	require.True(t, strings.HasSuffix(objects[0].URL, suffix), "unexpected object name %s", objects[0].URL)
+
+	compressed := compression == compressionGzip
+
+	manifest, err := bucket.ReadManifest(ctx, client, twicePath)
+	require.NoError(t, err)
+	require.Equal(t, twicePath, manifest.URL)
+	require.Len(t, manifest.Objects, 1)
+	require.Equal(t, objects[0].URL, manifest.Objects[0].URL)
+	require.Equal(t, objects[0].Size, manifest.Objects[0].Size)
+	require.Equal(t, int64(1001), manifest.Objects[0].Rows)
+	require.NotEmpty(t, manifest.Objects[0].MD5)
+
+	staged, err := bucket.ListObjects(ctx, client, twicePath+"/.staging")
+	require.NoError(t, err)
+	require.Empty(t, staged, "must promote all the staged objects")
+
+	// step 2 re-encrypts the object, and completes the destination.
+	localPath := filepath.Join(dir, "publisher_pair_id")
+	require.NoError(t, cfg.reEncrypt(ctx, localPath))
+
+	triple, err := bucket.ListObjects(ctx, client, triplePath)
+	require.NoError(t, err)
+	require.Len(t, triple, 1)
+	require.True(t, strings.HasSuffix(triple[0].URL, suffix), "unexpected object name %s", triple[0].URL)
+
+	entries, err := os.ReadDir(localPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "must write a local copy of the object")
+
+	_, err = os.Stat(filepath.Join(dir, "bucket", "publisher_triple_encrypted", bucket.CompletedFile))
+	require.NoError(t, err, "must complete the destination")
+
+	// the objects read are decompressed, and verified against the digests
+	// recorded by step 2.
+	readers, err := bucket.NewReaders(ctx, client, twicePath, bucket.WithSourceURL(triplePath))
+	require.NoError(t, err)
+	defer readers.Close()
+
+	if compressed {
+		require.Zero(t, readers.PubSize, "the size of compressed data is unknown")
+	} else {
+		require.Equal(t, objects[0].Size, readers.PubSize)
+	}
+
+	pubReaders := readersFromReadClosers(readers.PubReader)
+	require.NoError(t, cfg.verifyPublisherData(ctx, readers, pubReaders))
+
+	local, err := os.ReadFile(filepath.Join(localPath, entries[0].Name()))
+	require.NoError(t, err)
+	data, err := io.ReadAll(pubReaders[0])
+	require.NoError(t, err)
+	require.Equal(t, local, data, "must read the data of the local copy")
+
+	// the data as stored is recorded, compressed or not, and verified
+	// entirely before matching.
+	record, err := loadIntegrityRecord(cfg.integrityPath)
+	require.NoError(t, err)
+	require.Equal(t, triple[0].Size, record.Objects[triple[0].URL].StoredSize)
+
+	name := strings.TrimPrefix(triple[0].URL, "file://")
+	stored, err := os.ReadFile(name)
+	require.NoError(t, err)
+	stored[len(stored)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(name, stored, 0600))
+
+	tampered, err := bucket.NewReaders(ctx, client, twicePath, bucket.WithSourceURL(triplePath))
+	require.NoError(t, err)
+	defer tampered.Close()
+
+	err = cfg.verifyPublisherData(ctx, tampered, readersFromReadClosers(tampered.PubReader))
+	require.ErrorIs(t, err, ErrTampered)
+}
+
+// TestEncrypt_FileBucketConcurrentShards checks that step 1 uploads numbered
+// objects concurrently, each of them holding full rows within the limit.
+func TestEncrypt_FileBucketConcurrentShards(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	const total = 5000
+	var input strings.Builder
+	for i := range total {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	twicePath := "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		threads:         4,
+		shardRows:       500,
+		salt:            base64.StdEncoding.EncodeToString(salt),
+		key:             keyConfig.Key,
+		advTwicePath:    twicePath,
+	}
+
+	client, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the uploads are capped at the threads.
+	b, err := bucket.NewBucketReadWriter(ctx, client, twicePath,
+		bucket.WithReaders(strings.NewReader("")),
+		bucket.WithShardRows(cfg.shardRows),
+		bucket.WithShardUploads(cfg.threads),
+	)
+	require.NoError(t, err)
+	require.Len(t, b.ReadWriters[0].Writers(), cfg.threads)
+	b.Abort()
+
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+
+	objects, err := bucket.ListObjects(ctx, client, twicePath)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(objects), total/500)
+
+	rows := 0
+	for i, obj := range objects {
+		require.True(t, strings.HasSuffix(obj.URL, fmt.Sprintf("_%05d.csv", i)), "must number the objects, got %s", obj.URL)
+
+		data, err := os.ReadFile(strings.TrimPrefix(obj.URL, "file://"))
+		require.NoError(t, err)
+		require.True(t, bytes.HasSuffix(data, []byte("\n")), "object must end with a full row")
+
+		n := bytes.Count(data, []byte("\n"))
+		require.LessOrEqual(t, n, 500, "must roll over to a new object every 500 rows")
+		rows += n
+	}
+	require.Equal(t, total, rows, "must write all the rows")
+
+	manifest, err := bucket.ReadManifest(ctx, client, twicePath)
+	require.NoError(t, err)
+	require.Len(t, manifest.Objects, len(objects))
+}
+
+// TestPlan_FileBucket checks that the plan of step 2 names the objects as
+// they are written, and skips the objects re-encrypted by a previous run.
+func TestPlan_FileBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var input strings.Builder
+	for i := range 2002 {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	twicePath := "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+	triplePath := "file://" + filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		// a single upload, so that each object holds enough rows to be re-encrypted.
+		threads:       1,
+		shardRows:     1001,
+		salt:          base64.StdEncoding.EncodeToString(salt),
+		key:           keyConfig.Key,
+		advTwicePath:  twicePath,
+		pubTwicePath:  twicePath,
+		pubTriplePath: triplePath,
+	}
+
+	// step 1 writes two objects, re-encrypted by step 2 as if shipped by the publisher.
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+	require.NoError(t, cfg.reEncrypt(ctx, ""))
+
+	client, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer client.Close()
+
+	triple, err := bucket.ListObjects(ctx, client, triplePath)
+	require.NoError(t, err)
+	require.Len(t, triple, 2)
+
+	// resume step 2 with the first object left by the previous run.
+	tripleDir := filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	require.NoError(t, os.Remove(filepath.Join(tripleDir, bucket.CompletedFile)))
+	removed := strings.TrimPrefix(triple[1].URL, "file://")
+	require.NoError(t, os.Remove(removed))
+
+	runCommand := RunCmd{}
+	plan := &bytes.Buffer{}
+	require.NoError(t, runCommand.writePlan(ctx, plan, cfg, v1.Cleanroom_Participant_DATA_CONTRIBUTED, v1.Cleanroom_Participant_DATA_CONTRIBUTED))
+
+	staging, err := bucket.StagingURL(triplePath)
+	require.NoError(t, err)
+	var (
+		kept    = strings.TrimPrefix(triple[0].URL, triplePath)
+		written = strings.TrimPrefix(triple[1].URL, triplePath)
+	)
+
+	// the objects are staged, promoted, and listed in the manifest.
+	require.Contains(t, plan.String(), fmt.Sprintf("skipped: %s, already written from", triple[0].URL))
+	require.NotContains(t, plan.String(), fmt.Sprintf("promote: %s%s", staging, kept))
+	require.Contains(t, plan.String(), fmt.Sprintf("write:   %s%s\n", staging, written))
+	require.Contains(t, plan.String(), fmt.Sprintf("promote: %s%s -> %s\n", staging, written, triple[1].URL))
+	require.Contains(t, plan.String(), fmt.Sprintf("write:   %s/%s\n", triplePath, bucket.ManifestFile))
+	require.Contains(t, plan.String(), fmt.Sprintf("write:   %s/%s\n", triplePath, bucket.CompletedFile))
+}
+
+// TestMatch_FileBucketTampered checks that the results of a match are removed
+// when the matcher reads tampered publisher data, which the storage and the
+// integrity record cannot tell apart before matching: a file:// bucket
+// provides no CRC32C checksums, and the records of earlier versions of opair
+// have no digest of the data as stored.
+func TestReEncrypt_FileBucketForeignObject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var input strings.Builder
+	for i := range 1001 {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	twicePath := "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+	triplePath := "file://" + filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		threads:         1,
+		salt:            base64.StdEncoding.EncodeToString(salt),
+		key:             keyConfig.Key,
+		advTwicePath:    twicePath,
+		pubTwicePath:    twicePath,
+		pubTriplePath:   triplePath,
+	}
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+
+	// an object not written by opair is under the destination of step 2.
+	tripleDir := filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	require.NoError(t, os.MkdirAll(tripleDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(tripleDir, "foreign.csv"), []byte("foreign\n"), 0600))
+
+	err = cfg.reEncrypt(ctx, "")
+	require.ErrorIs(t, err, bucket.ErrForeignObject)
+
+	client, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer client.Close()
+
+	triple, err := bucket.ListObjects(ctx, client, triplePath)
+	require.NoError(t, err)
+	require.Len(t, triple, 1, "must leave the destination untouched")
+	require.Equal(t, triplePath+"/foreign.csv", triple[0].URL)
+}
+
+// TestPAIR_FileBucketMixedCompression checks that the steps read compressed
+// and uncompressed prefixes alike, each object decompressed on its own, while
+// writing with the compression asked for regardless of the data read.
+func TestPAIR_FileBucketMixedCompression(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var input strings.Builder
+	for i := range 1001 {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		data, err := proto.Marshal(&v1.Cleanroom{
+			Participants: []*v1.Cleanroom_Participant{
+				{Role: v1.Cleanroom_Participant_PUBLISHER, State: v1.Cleanroom_Participant_DATA_TRANSFORMED},
+			},
+		})
+		if err != nil {
+			t.Errorf("failed to marshal response: %v", err)
+		}
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	client, err := internal.NewCleanroomClient(&internal.CleanroomToken{Cleanroom: "cleanrooms/test", IssuerHost: server.URL})
+	require.NoError(t, err)
+
+	var (
+		advTwicePath  = "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+		advTriplePath = "file://" + filepath.Join(dir, "bucket", "advertiser_triple_encrypted")
+		pubTwicePath  = "file://" + filepath.Join(dir, "bucket", "publisher_twice_encrypted")
+		pubTriplePath = "file://" + filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	)
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		threads:         1,
+		salt:            base64.StdEncoding.EncodeToString(salt),
+		key:             keyConfig.Key,
+		cleanroomClient: client,
+		advTwicePath:    advTwicePath,
+		advTriplePath:   advTriplePath,
+		pubTwicePath:    pubTwicePath,
+		pubTriplePath:   pubTriplePath,
+		integrityPath:   filepath.Join(dir, "integrity.json"),
+	}
+
+	// the publisher twice encrypted data is compressed, the advertiser one is not.
+	publisher := *cfg
+	publisher.compression = compressionGzip
+	publisher.advTwicePath = pubTwicePath
+	require.NoError(t, publisher.hashEncryt(ctx, inputPath))
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+
+	storageClient, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer storageClient.Close()
+
+	for path, suffix := range map[string]string{pubTwicePath: ".csv.gz", advTwicePath: ".csv"} {
+		objects, err := bucket.ListObjects(ctx, storageClient, path)
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.True(t, strings.HasSuffix(objects[0].URL, suffix), "unexpected object name %s", objects[0].URL)
+	}
+
+	// step 2 writes uncompressed data from the compressed publisher data.
+	require.NoError(t, cfg.reEncrypt(ctx, ""))
+
+	triple, err := bucket.ListObjects(ctx, storageClient, pubTriplePath)
+	require.NoError(t, err)
+	require.Len(t, triple, 1)
+	require.True(t, strings.HasSuffix(triple[0].URL, ".csv"), "must not follow the compression of the data read, got %s", triple[0].URL)
+
+	// the advertiser triple encrypted data is the publisher one, compressed, so that all of it matches.
+	advertiser := *cfg
+	advertiser.compression = compressionGzip
+	advertiser.pubTriplePath = advTriplePath
+	advertiser.integrityPath = filepath.Join(dir, "advertiser_integrity.json")
+	require.NoError(t, advertiser.reEncrypt(ctx, ""))
+
+	// act
+	output := filepath.Join(dir, "output")
+	err = cfg.match(ctx, output, "")
+
+	// assert
+	require.NoError(t, err)
+	results, err := os.ReadDir(output)
+	require.NoError(t, err)
+	require.NotEmpty(t, results, "must write the results of the match")
+}
+
+func TestMatch_FileBucketTampered(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var input strings.Builder
+	for i := range 1001 {
+		fmt.Fprintf(&input, "%x\n", sha256.Sum256([]byte(fmt.Sprintf("%d@gmail.com", i))))
+	}
+	inputPath := filepath.Join(dir, "input.csv")
+	require.NoError(t, os.WriteFile(inputPath, []byte(input.String()), 0600))
+
+	salt := make([]byte, sha256SaltSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	keyConfig, err := keys.GenerateKeyConfig()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		data, err := proto.Marshal(&v1.Cleanroom{
+			Participants: []*v1.Cleanroom_Participant{
+				{Role: v1.Cleanroom_Participant_PUBLISHER, State: v1.Cleanroom_Participant_DATA_TRANSFORMED},
+			},
+		})
+		if err != nil {
+			t.Errorf("failed to marshal response: %v", err)
+		}
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	client, err := internal.NewCleanroomClient(&internal.CleanroomToken{Cleanroom: "cleanrooms/test", IssuerHost: server.URL})
+	require.NoError(t, err)
+
+	// the advertiser triple encrypted data is the publisher one, so that all of it matches.
+	twicePath := "file://" + filepath.Join(dir, "bucket", "advertiser_twice_encrypted")
+	triplePath := "file://" + filepath.Join(dir, "bucket", "publisher_triple_encrypted")
+	cfg := &pairConfig{
+		downscopedToken: "token",
+		threads:         1,
+		salt:            base64.StdEncoding.EncodeToString(salt),
+		key:             keyConfig.Key,
+		cleanroomClient: client,
+		advTwicePath:    twicePath,
+		advTriplePath:   triplePath,
+		pubTwicePath:    twicePath,
+		pubTriplePath:   triplePath,
+		integrityPath:   filepath.Join(dir, "integrity.json"),
+	}
+	require.NoError(t, cfg.hashEncryt(ctx, inputPath))
+	require.NoError(t, cfg.reEncrypt(ctx, ""))
+
+	record, err := loadIntegrityRecord(cfg.integrityPath)
+	require.NoError(t, err)
+	for url, digest := range record.Objects {
+		record.Objects[url] = digest.withStored(0, "")
+	}
+	require.NoError(t, record.save())
+
+	// the publisher swaps the first two rows of the data, keeping its size.
+	storageClient, err := bucket.NewClient(cfg.downscopedToken)
+	require.NoError(t, err)
+	defer storageClient.Close()
+
+	triple, err := bucket.ListObjects(ctx, storageClient, triplePath)
+	require.NoError(t, err)
+	require.Len(t, triple, 1)
+
+	name := strings.TrimPrefix(triple[0].URL, "file://")
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	rows := strings.SplitAfter(string(data), "\n")
+	rows[0], rows[1] = rows[1], rows[0]
+	require.NoError(t, os.WriteFile(name, []byte(strings.Join(rows, "")), 0600))
+
+	// act
+	output := filepath.Join(dir, "output")
+	err = cfg.match(ctx, output, "")
+
+	// assert
+	require.ErrorIs(t, err, ErrTampered)
+	require.ErrorContains(t, err, "matcher.Match")
+
+	results, err := os.ReadDir(output)
+	require.NoError(t, err)
+	require.Empty(t, results, "must remove the results of tampered data")
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"optable-pair-cli/pkg/bucket"
+	"optable-pair-cli/pkg/pair"
+	"os"
+)
+
+type VerifyCmd struct {
+	PairCleanroomToken string `arg:"" help:"The PAIR clean room token to use for the operation. You can find this by logging into the Optable PAIR Connector UI to which you were invited."`
+}
+
+func (c *VerifyCmd) Run(cli *CmdContext) error {
+	ctx := cli.Context()
+
+	if c.PairCleanroomToken == "" {
+		return ErrTokenRequired
+	}
+	cli.redact(c.PairCleanroomToken)
+
+	pairCfg, paths, err := pairDataPaths(ctx, cli, c.PairCleanroomToken)
+	if err != nil {
+		return err
+	}
+
+	return verifyCleanroom(ctx, os.Stdout, pairCfg, paths)
+}
+
+// verifier prints the outcome of each check, counting the failed ones.
+type verifier struct {
+	*planWriter
+	checks int
+	failed int
+}
+
+func (v *verifier) check(passed bool, format string, args ...any) {
+	v.checks++
+	status := "PASS"
+	if !passed {
+		status = "FAIL"
+		v.failed++
+	}
+
+	v.printf("  %s  "+format, append([]any{status}, args...)...)
+}
+
+// verifyCleanroom audits the PAIR data paths of the clean room without
+// changing them, and prints a report: each path must hold a .Completed file,
+// every row must be an encrypted PAIR ID, the rows must match the manifest if
+// any, and each triple encrypted dataset must hold as many rows as the twice
+// encrypted one it was re-encrypted from. It fails with ErrVerificationFailed
+// if any check fails.
+func verifyCleanroom(ctx context.Context, w io.Writer, pairCfg *pairConfig, paths []dataPath) error {
+	client, err := pairCfg.newStorageClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	v := &verifier{planWriter: &planWriter{w: w}}
+	rows := make(map[string]uint64, len(paths))
+	for _, path := range paths {
+		v.printf("%s: %s", path.name, path.url)
+
+		ids, err := verifyPath(ctx, v, client, path.url)
+		if err != nil {
+			return err
+		}
+		rows[path.name] = ids.Rows
+		v.check(ids.Invalid == 0, "%d of %d rows are valid Ristretto255 points", ids.Rows-ids.Invalid, ids.Rows)
+
+		manifest, err := bucket.ReadManifest(ctx, client, path.url)
+		if errors.Is(err, bucket.ErrNoManifest) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("bucket.ReadManifest: %w", err)
+		}
+
+		var manifestRows int64
+		for _, obj := range manifest.Objects {
+			manifestRows += obj.Rows
+		}
+		v.check(uint64(manifestRows) == ids.Rows, "%d rows equal the %d rows listed by %s", ids.Rows, manifestRows, bucket.ManifestFile)
+	}
+
+	v.printf("row counts:")
+	for _, p := range [][2]string{{publisherTriple, publisherTwice}, {advertiserTriple, advertiserTwice}} {
+		triple, twice := p[0], p[1]
+		v.check(rows[triple] == rows[twice], "%s rows (%d) equal %s rows (%d)", triple, rows[triple], twice, rows[twice])
+	}
+
+	v.printf("%d checks, %d failed", v.checks, v.failed)
+	if v.err != nil {
+		return v.err
+	}
+
+	if v.failed > 0 {
+		return fmt.Errorf("%w: %d of %d checks failed", ErrVerificationFailed, v.failed, v.checks)
+	}
+
+	return nil
+}
+
+// verifyPath checks that the .Completed file is written under the path and
+// that its rows are encrypted PAIR IDs, and returns the outcome of the latter.
+func verifyPath(ctx context.Context, v *verifier, client *bucket.Client, url string) (pair.IDCheck, error) {
+	pBucket, err := bucket.ParseURL(url)
+	if err != nil {
+		return pair.IDCheck{}, fmt.Errorf("bucket.ParseURL: %w", err)
+	}
+
+	completed, err := bucket.HasCompleted(ctx, client, pBucket)
+	if err != nil {
+		return pair.IDCheck{}, fmt.Errorf("bucket.HasCompleted: %w", err)
+	}
+	v.check(completed, "%s is written", bucket.CompletedFile)
+
+	readers, err := bucket.ReadersFromPrefixedBucket(ctx, client, pBucket)
+	if err != nil {
+		return pair.IDCheck{}, fmt.Errorf("bucket.ReadersFromPrefixedBucket: %w", err)
+	}
+
+	ids, err := pair.CheckPAIRIDs(ctx, readersFromReadClosers(readers))
+	for _, r := range readers {
+		r.Close()
+	}
+	if err != nil {
+		return pair.IDCheck{}, fmt.Errorf("pair.CheckPAIRIDs: %w", err)
+	}
+
+	return ids, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"optable-pair-cli/pkg/cmd/cli"
+	"os"
 	"path/filepath"
 
 	"github.com/adrg/xdg"
@@ -25,9 +27,18 @@ https://github.com/Optable/match/blob/main/pkg/pair/README.md and
 https://iabtechlab.com/pair/
 `
 
-var keyConfigPath = filepath.Join("opair", "key", "key.json")
+var (
+	keyConfigPath      = filepath.Join("opair", "key", "key.json")
+	settingsConfigPath = filepath.Join("opair", "config.yaml")
+)
 
 func main() {
+	settings, err := loadSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opair: error: %s\n", err)
+		os.Exit(cli.ExitFailure)
+	}
+
 	var c cli.Cli
 	kongCtx := kong.Parse(&c,
 		kong.Name("opair"),
@@ -40,6 +51,10 @@ func main() {
 			NoExpandSubcommands: true,
 			WrapUpperBound:      80,
 		},
+		// flags are resolved in order from the command line, the OPAIR_*
+		// environment variables, the profile of the settings file and their defaults.
+		kong.DefaultEnvars(cli.EnvPrefix),
+		kong.Resolvers(settings),
 	)
 
 	configPath := c.AdvertiserKeyPath
@@ -53,11 +68,29 @@ func main() {
 
 	conf, err := cli.LoadKeyConfig(c.Context, configPath, false)
 	if err != nil {
-		kongCtx.FatalIfErrorf(err)
+		kongCtx.Errorf("%s", err)
+		kongCtx.Exit(cli.ExitCode(err))
 	}
 
 	cliCtx, err := c.NewContext(conf)
 	kongCtx.FatalIfErrorf(err)
 
-	kongCtx.FatalIfErrorf(kongCtx.Run(cliCtx))
+	if err := kongCtx.Run(cliCtx, settings); err != nil {
+		err = cliCtx.Interrupted(err)
+		cliCtx.Log().Error().Err(err).Str("error_code", cli.ErrorCode(err)).Msg("opair failed")
+		cliCtx.LogResumeCommand(err, os.Args)
+		cliCtx.Close()
+		kongCtx.Exit(cli.ExitCode(err))
+	}
+
+	cliCtx.Close()
+}
+
+func loadSettings() (*cli.Settings, error) {
+	path, err := xdg.ConfigFile(settingsConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.LoadSettings(cli.SettingsPath(path))
 }
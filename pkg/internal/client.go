@@ -3,36 +3,184 @@ package internal
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"optable-pair-cli/pkg/metrics"
+	"optable-pair-cli/pkg/tracing"
+	"strconv"
 	"strings"
 	"time"
 
 	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	waitTime = 1 * time.Hour
+	defaultPollInterval    = 1 * time.Second
+	defaultPollBackoff     = 1.0
+	defaultPollMaxInterval = 1 * time.Minute
+	defaultPollTimeout     = 1 * time.Hour
 
 	AdminCleanroomGetURL          = "/admin/api/external/v1/cleanroom/get"
 	AdminCleanroomRefreshTokenURL = "/admin/api/external/v1/cleanroom/refresh-token"
 	AdminCleanroomAdvanceURL      = "/admin/api/external/v1/cleanroom/advance-advertiser-state"
 )
 
+var (
+	// ErrTerminalState is returned when waiting for a publisher that reached a terminal state.
+	ErrTerminalState = errors.New("publisher reached a terminal state")
+	// ErrWaitTimeout is returned when the publisher did not reach the expected state in time.
+	ErrWaitTimeout = errors.New("timeout")
+	// ErrUnauthorized is returned when the API rejects the clean room token, for instance when it expired.
+	ErrUnauthorized = errors.New("unauthorized, the clean room token is invalid or expired")
+	// ErrForbidden is returned when the API denies access to the clean room.
+	ErrForbidden = errors.New("forbidden")
+	// ErrUnexpectedStatus is returned when the API responds with any other unexpected status code.
+	ErrUnexpectedStatus = errors.New("unexpected status code")
+)
+
+// terminalStates are the publisher states from which a clean room can never progress.
+var terminalStates = []v1.Cleanroom_Participant_State{
+	v1.Cleanroom_Participant_FAILED,
+	v1.Cleanroom_Participant_REJECTED,
+	v1.Cleanroom_Participant_REVOKED,
+}
+
 type (
 	CleanroomClient struct {
 		client        *http.Client
 		url           string
 		token         string
 		cleanroomName string
+		pollPolicy    PollPolicy
+	}
+
+	// PollPolicy configures how often WaitForState polls the clean room, and for how long.
+	PollPolicy struct {
+		// Interval is the delay between the first two polls.
+		Interval time.Duration
+		// Backoff is the factor by which the delay grows after each poll.
+		// A factor of 1 polls at a constant interval.
+		Backoff float64
+		// MaxInterval caps the delay between two polls.
+		MaxInterval time.Duration
+		// Timeout is the overall time to wait for.
+		Timeout time.Duration
+	}
+
+	// ClientOption allows to configure the behavior of the CleanroomClient.
+	ClientOption func(*CleanroomClient)
+
+	// StateObserver is called with the publisher's state and the time spent
+	// waiting so far, every time the clean room is polled.
+	StateObserver func(state v1.Cleanroom_Participant_State, elapsed time.Duration)
+
+	waitOptions struct {
+		timeout  time.Duration
+		observer StateObserver
 	}
+
+	// WaitOption allows to configure the behavior of WaitForState.
+	WaitOption func(*waitOptions)
 )
 
-func NewCleanroomClient(token *CleanroomToken) (*CleanroomClient, error) {
-	hostURL := strings.TrimRight(token.IssuerHost, "/")
+// DefaultPollPolicy returns the policy used when none is provided, which polls
+// every second for up to an hour.
+func DefaultPollPolicy() PollPolicy {
+	return PollPolicy{
+		Interval:    defaultPollInterval,
+		Backoff:     defaultPollBackoff,
+		MaxInterval: defaultPollMaxInterval,
+		Timeout:     defaultPollTimeout,
+	}
+}
+
+// Validate checks that the policy is usable.
+func (p PollPolicy) Validate() error {
+	if p.Interval <= 0 {
+		return errors.New("poll interval must be greater than 0")
+	}
+
+	if p.Backoff < 1 {
+		return errors.New("poll backoff must be greater than or equal to 1")
+	}
+
+	if p.MaxInterval < p.Interval {
+		return errors.New("poll max interval must be greater than or equal to the poll interval")
+	}
+
+	if p.Timeout <= 0 {
+		return errors.New("poll timeout must be greater than 0")
+	}
+
+	return nil
+}
+
+// next returns the delay to wait for after the given one.
+func (p PollPolicy) next(interval time.Duration) time.Duration {
+	next := time.Duration(float64(interval) * p.Backoff)
+	if next > p.MaxInterval {
+		return p.MaxInterval
+	}
+
+	return next
+}
+
+// WithPollPolicy sets the policy used by WaitForState.
+func WithPollPolicy(policy PollPolicy) ClientOption {
+	return func(c *CleanroomClient) {
+		c.pollPolicy = policy
+	}
+}
+
+// WithWaitTimeout overrides the maximum time to wait for the publisher.
+func WithWaitTimeout(timeout time.Duration) WaitOption {
+	return func(o *waitOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithStateObserver registers a function that is called after every poll.
+func WithStateObserver(observer StateObserver) WaitOption {
+	return func(o *waitOptions) {
+		o.observer = observer
+	}
+}
+
+// WithEndpoint overrides the API endpoint found in the clean room token.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *CleanroomClient) {
+		c.url = endpoint
+	}
+}
+
+// WithHTTPTimeout sets the timeout of each request to the API. A zero timeout means no timeout.
+func WithHTTPTimeout(timeout time.Duration) ClientOption {
+	return func(c *CleanroomClient) {
+		c.client.Timeout = timeout
+	}
+}
+
+func NewCleanroomClient(token *CleanroomToken, opts ...ClientOption) (*CleanroomClient, error) {
+	client := &CleanroomClient{
+		client:        &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		token:         token.Raw,
+		cleanroomName: token.Cleanroom,
+		url:           token.IssuerHost,
+		pollPolicy:    DefaultPollPolicy(),
+	}
+
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	hostURL := strings.TrimRight(client.url, "/")
 	host, err := url.Parse(hostURL)
 	if err != nil {
 		return nil, err
@@ -41,13 +189,13 @@ func NewCleanroomClient(token *CleanroomToken) (*CleanroomClient, error) {
 	if host.Scheme == "" {
 		hostURL = "https://" + hostURL
 	}
+	client.url = hostURL
 
-	return &CleanroomClient{
-		client:        http.DefaultClient,
-		token:         token.Raw,
-		cleanroomName: token.Cleanroom,
-		url:           hostURL,
-	}, nil
+	if err := client.pollPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid poll policy: %w", err)
+	}
+
+	return client, nil
 }
 
 func (c *CleanroomClient) GetCleanroom(ctx context.Context, sensitive bool) (*v1.Cleanroom, error) {
@@ -111,7 +259,7 @@ func (c *CleanroomClient) GetConfig(ctx context.Context) (*v1.Cleanroom_Config_P
 	return cleanroom.GetConfig().GetPair(), nil
 }
 
-func (c *CleanroomClient) ReadyForMatch(ctx context.Context) error {
+func (c *CleanroomClient) ReadyForMatch(ctx context.Context, opts ...WaitOption) error {
 	return c.WaitForState(
 		ctx,
 		[]v1.Cleanroom_Participant_State{
@@ -119,28 +267,67 @@ func (c *CleanroomClient) ReadyForMatch(ctx context.Context) error {
 			v1.Cleanroom_Participant_RUNNING,
 			v1.Cleanroom_Participant_SUCCEEDED,
 		},
+		opts...,
 	)
 }
 
-func (c *CleanroomClient) WaitForState(ctx context.Context, states []v1.Cleanroom_Participant_State) error {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+// PublisherContributed waits until the publisher has contributed its data,
+// which is required before the advertiser can start the PAIR protocol.
+func (c *CleanroomClient) PublisherContributed(ctx context.Context, opts ...WaitOption) error {
+	return c.WaitForState(
+		ctx,
+		[]v1.Cleanroom_Participant_State{
+			v1.Cleanroom_Participant_DATA_CONTRIBUTED,
+			v1.Cleanroom_Participant_DATA_TRANSFORMING,
+			v1.Cleanroom_Participant_DATA_TRANSFORMED,
+			v1.Cleanroom_Participant_RUNNING,
+			v1.Cleanroom_Participant_SUCCEEDED,
+		},
+		opts...,
+	)
+}
+
+// WaitForState polls the clean room following the client's PollPolicy until the
+// publisher reaches one of the given states. The first poll happens right away,
+// so a clean room that is already in the expected state does not wait for an
+// interval. It fails as soon as the publisher reaches a terminal state, since
+// the clean room can not progress anymore.
+func (c *CleanroomClient) WaitForState(ctx context.Context, states []v1.Cleanroom_Participant_State, opts ...WaitOption) error {
+	waitOption := &waitOptions{timeout: c.pollPolicy.Timeout}
+	for _, opt := range opts {
+		opt(waitOption)
+	}
+
+	var (
+		logger    = zerolog.Ctx(ctx)
+		startTime = time.Now()
+		interval  = c.pollPolicy.Interval
+		lastState v1.Cleanroom_Participant_State
+	)
+
+	// poll right away, the policy only applies to the delays between polls.
+	poll := time.NewTimer(0)
+	defer poll.Stop()
 
-	timer := time.NewTimer(1 * time.Hour)
+	timer := time.NewTimer(waitOption.timeout)
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			// the cause tells apart the deadline of the step or the command from a cancellation.
+			return context.Cause(ctx)
 		case <-timer.C:
-			return fmt.Errorf("timeout after %v", waitTime)
-		case <-ticker.C:
+			return fmt.Errorf("%w after %v", ErrWaitTimeout, waitOption.timeout)
+		case <-poll.C:
 			// check state
 		}
 
 		cleanroom, err := c.GetCleanroom(ctx, false)
 		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
 			return err
 		}
 
@@ -153,15 +340,42 @@ func (c *CleanroomClient) WaitForState(ctx context.Context, states []v1.Cleanroo
 			}
 		}
 
-		for _, state := range states {
-			if publisher.GetState() == state {
+		state := publisher.GetState()
+		if state != lastState {
+			logger.Info().
+				Str("publisher_state", state.String()).
+				Str("elapsed", time.Since(startTime).Round(time.Second).String()).
+				Msg("publisher state changed")
+			lastState = state
+		}
+
+		if waitOption.observer != nil {
+			waitOption.observer(state, time.Since(startTime))
+		}
+
+		for _, terminal := range terminalStates {
+			if state == terminal {
+				return fmt.Errorf("%w: %s", ErrTerminalState, state)
+			}
+		}
+
+		for _, expected := range states {
+			if state == expected {
 				return nil
 			}
 		}
+
+		poll.Reset(interval)
+		interval = c.pollPolicy.next(interval)
 	}
 }
 
-func (c *CleanroomClient) do(ctx context.Context, req proto.Message) (*v1.Cleanroom, error) {
+func (c *CleanroomClient) do(ctx context.Context, req proto.Message) (res *v1.Cleanroom, err error) {
+	ctx, span := tracing.Start(ctx, "CleanroomClient."+string(req.ProtoReflect().Descriptor().Name()),
+		attribute.String("cleanroom", c.cleanroomName),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	msg, err := proto.Marshal(req)
 	if err != nil {
 		return nil, err
@@ -189,22 +403,31 @@ func (c *CleanroomClient) do(ctx context.Context, req proto.Message) (*v1.Cleanr
 	httpReq.Header.Add("Authorization", "Bearer "+c.token)
 	httpReq.Header.Add("Content-Type", "application/protobuf")
 
+	startTime := time.Now()
 	httpResp, err := c.client.Do(httpReq)
 	if err != nil {
+		metrics.APIRequestDuration.WithLabelValues(path, "error").Observe(time.Since(startTime).Seconds())
 		return nil, err
 	}
 	defer httpResp.Body.Close()
+	metrics.APIRequestDuration.WithLabelValues(path, strconv.Itoa(httpResp.StatusCode)).Observe(time.Since(startTime).Seconds())
 
 	body, err := io.ReadAll(httpResp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", httpResp.StatusCode)
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("%w: %w: %d", ErrUnauthorized, ErrUnexpectedStatus, httpResp.StatusCode)
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %w: %d", ErrForbidden, ErrUnexpectedStatus, httpResp.StatusCode)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnexpectedStatus, httpResp.StatusCode)
 	}
 
-	res := &v1.Cleanroom{}
+	res = &v1.Cleanroom{}
 	if err := proto.Unmarshal(body, res); err != nil {
 		return nil, err
 	}
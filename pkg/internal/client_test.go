@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/optable/match-api/v2/gen/optable/external/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWaitForState(t *testing.T) {
+	t.Parallel()
+
+	// publisher contributes its data on the second poll
+	var polls atomic.Int32
+	server := newCleanroomServer(t, func() v1.Cleanroom_Participant_State {
+		if polls.Add(1) < 2 {
+			return v1.Cleanroom_Participant_INVITED
+		}
+		return v1.Cleanroom_Participant_DATA_CONTRIBUTED
+	})
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	var observed []v1.Cleanroom_Participant_State
+	err := client.PublisherContributed(
+		context.Background(),
+		WithStateObserver(func(state v1.Cleanroom_Participant_State, _ time.Duration) {
+			observed = append(observed, state)
+		}),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []v1.Cleanroom_Participant_State{
+		v1.Cleanroom_Participant_INVITED,
+		v1.Cleanroom_Participant_DATA_CONTRIBUTED,
+	}, observed)
+}
+
+func TestWaitForState_PollsImmediately(t *testing.T) {
+	t.Parallel()
+
+	server := newCleanroomServer(t, func() v1.Cleanroom_Participant_State {
+		return v1.Cleanroom_Participant_DATA_CONTRIBUTED
+	})
+	defer server.Close()
+
+	policy := DefaultPollPolicy()
+	policy.Interval = time.Hour
+	policy.MaxInterval = time.Hour
+	client, err := NewCleanroomClient(&CleanroomToken{
+		Cleanroom:  "cleanrooms/test",
+		IssuerHost: server.URL,
+	}, WithPollPolicy(policy))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a clean room that is already ready does not wait for the poll interval.
+	require.NoError(t, client.PublisherContributed(ctx))
+}
+
+func TestWaitForState_TerminalState(t *testing.T) {
+	t.Parallel()
+
+	server := newCleanroomServer(t, func() v1.Cleanroom_Participant_State {
+		return v1.Cleanroom_Participant_REJECTED
+	})
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	err := client.PublisherContributed(context.Background())
+	require.ErrorIs(t, err, ErrTerminalState)
+	require.Contains(t, err.Error(), v1.Cleanroom_Participant_REJECTED.String())
+}
+
+func TestWaitForState_Timeout(t *testing.T) {
+	t.Parallel()
+
+	server := newCleanroomServer(t, func() v1.Cleanroom_Participant_State {
+		return v1.Cleanroom_Participant_INVITED
+	})
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	err := client.PublisherContributed(context.Background(), WithWaitTimeout(150*time.Millisecond))
+	require.ErrorIs(t, err, ErrWaitTimeout)
+	require.Contains(t, err.Error(), "timeout after 150ms")
+}
+
+func TestWaitForState_ContextDeadline(t *testing.T) {
+	t.Parallel()
+
+	server := newCleanroomServer(t, func() v1.Cleanroom_Participant_State {
+		return v1.Cleanroom_Participant_INVITED
+	})
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	cause := fmt.Errorf("step3 exceeded the step timeout: %w", context.DeadlineExceeded)
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 150*time.Millisecond, cause)
+	defer cancel()
+
+	err := client.PublisherContributed(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, cause)
+}
+
+func TestDo_PropagatesTraceContext(t *testing.T) {
+	t.Parallel()
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("traceparent"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	ctx, span := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+
+	_, err := client.GetCleanroom(ctx, false)
+	require.NoError(t, err)
+	require.Contains(t, traceparent.Load(), span.SpanContext().TraceID().String())
+}
+
+func TestDo_Unauthorized(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := requireNewCleanroomClient(t, server.URL)
+
+	_, err := client.GetCleanroom(context.Background(), false)
+	require.ErrorIs(t, err, ErrUnauthorized)
+	require.ErrorIs(t, err, ErrUnexpectedStatus)
+	require.Contains(t, err.Error(), "401")
+}
+
+func TestPollPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := PollPolicy{
+		Interval:    time.Second,
+		Backoff:     2,
+		MaxInterval: 5 * time.Second,
+		Timeout:     time.Minute,
+	}
+	require.NoError(t, policy.Validate())
+
+	var intervals []time.Duration
+	for interval := policy.Interval; len(intervals) < 5; interval = policy.next(interval) {
+		intervals = append(intervals, interval)
+	}
+	require.Equal(t, []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}, intervals)
+
+	invalid := policy
+	invalid.Backoff = 0.5
+	require.Error(t, invalid.Validate())
+
+	invalid = policy
+	invalid.MaxInterval = time.Millisecond
+	require.Error(t, invalid.Validate())
+}
+
+func newCleanroomServer(t *testing.T, publisherState func() v1.Cleanroom_Participant_State) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != AdminCleanroomGetURL {
+			t.Errorf("Unexpected call %s", r.URL.Path)
+			return
+		}
+
+		data, err := proto.Marshal(&v1.Cleanroom{
+			Participants: []*v1.Cleanroom_Participant{
+				{
+					Role:  v1.Cleanroom_Participant_PUBLISHER,
+					State: publisherState(),
+				},
+				{
+					Role:  v1.Cleanroom_Participant_ADVERTISER,
+					State: v1.Cleanroom_Participant_INVITED,
+				},
+			},
+		})
+		if err != nil {
+			t.Errorf("Failed to marshal response: %v", err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(data); err != nil {
+			t.Errorf("Failed to write response body: %v", err)
+		}
+	}))
+}
+
+func requireNewCleanroomClient(t *testing.T, url string) *CleanroomClient {
+	t.Helper()
+
+	policy := DefaultPollPolicy()
+	policy.Interval = 10 * time.Millisecond
+
+	client, err := NewCleanroomClient(&CleanroomToken{
+		Cleanroom:  "cleanrooms/test",
+		IssuerHost: url,
+	}, WithPollPolicy(policy))
+	require.NoError(t, err)
+
+	return client
+}
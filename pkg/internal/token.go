@@ -1,12 +1,16 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// ErrInvalidToken is returned when the clean room token cannot be parsed.
+var ErrInvalidToken = errors.New("invalid clean room token")
+
 type CleanroomToken struct {
 	Raw        string
 	Cleanroom  string  `json:"cleanroom"`
@@ -44,7 +48,7 @@ func ParseCleanroomToken(token string) (*CleanroomToken, error) {
 
 	_, _, err := parser.ParseUnverified(token, claims)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 
 	return claims, err
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"gocloud.dev/blob/gcsblob"
 )
@@ -13,15 +14,54 @@ import (
 type (
 	ReadCloser  = io.ReadCloser
 	Reader      = io.Reader
+	Writer      = io.Writer
 	WriteCloser = io.WriteCloser
 )
 
 var EOF = io.EOF
 
+func Copy(dst Writer, src Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+// Counter counts the bytes read through the readers it wraps. It is safe for concurrent use.
+type Counter struct {
+	n atomic.Int64
+}
+
+type countingReader struct {
+	r io.Reader
+	c *Counter
+}
+
+// Reader wraps r so that the bytes read from it are added to the counter.
+func (c *Counter) Reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, c: c}
+}
+
+// Count returns the number of bytes read so far.
+func (c *Counter) Count() int64 {
+	return c.n.Load()
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.n.Add(int64(n))
+	return n, err
+}
+
 func MultiReader(readers ...io.Reader) io.Reader {
 	return io.MultiReader(readers...)
 }
 
+func MultiWriter(writers ...io.Writer) io.Writer {
+	return io.MultiWriter(writers...)
+}
+
+func TeeReader(r io.Reader, w io.Writer) io.Reader {
+	return io.TeeReader(r, w)
+}
+
 func FileReaders(path string) ([]io.Reader, error) {
 	if path == "" {
 		return []io.Reader{os.Stdin}, nil
@@ -62,6 +102,45 @@ func FileReaders(path string) ([]io.Reader, error) {
 	return readers, nil
 }
 
+// Size returns the size in bytes of the file, or of all files of the directory
+// as read by FileReaders. It returns 0 when reading from stdin.
+func Size(path string) (int64, error) {
+	if path == "" {
+		return 0, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("os.Stat: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return fi.Size(), nil
+	}
+
+	dirEntry, err := os.ReadDir(path)
+	if err != nil {
+		return 0, fmt.Errorf("os.ReadDir: %w", err)
+	}
+
+	var size int64
+	for _, entry := range dirEntry {
+		// ignore subdirectories
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return 0, fmt.Errorf("entry.Info: %w", err)
+		}
+
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
 func FileWriter(path string) (io.Writer, error) {
 	if path == "" {
 		return os.Stdout, nil
@@ -0,0 +1,98 @@
+package io
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// minChunkSize is the minimum size of the chunks a file is split into, below
+// which parsing them concurrently is not worth it.
+const minChunkSize = 16 << 20
+
+// Split splits the local files among the readers into up to n chunks each,
+// at newline boundaries, so that they can be parsed concurrently. Files are
+// only split in chunks of at least 16MiB. Readers that are not regular files,
+// e.g. stdin or GCS objects, are returned as is.
+//
+// The files must hold one record per line, without quoted newlines, like the
+// files of identifiers read by opair.
+func Split(readers []io.Reader, n int) ([]io.Reader, error) {
+	var chunks []io.Reader
+	for _, r := range readers {
+		f, ok := r.(*os.File)
+		if !ok {
+			chunks = append(chunks, r)
+			continue
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("f.Stat: %w", err)
+		}
+
+		k := min(int64(n), info.Size()/minChunkSize)
+		if !info.Mode().IsRegular() || k <= 1 {
+			chunks = append(chunks, r)
+			continue
+		}
+
+		fileChunks, err := split(f, info.Size(), int(k))
+		if err != nil {
+			return nil, fmt.Errorf("split %s: %w", f.Name(), err)
+		}
+
+		chunks = append(chunks, fileChunks...)
+	}
+
+	return chunks, nil
+}
+
+// split splits the content of r, of the given size, into up to k chunks of
+// about the same size. Every chunk but the last ends with a newline.
+func split(r io.ReaderAt, size int64, k int) ([]io.Reader, error) {
+	var (
+		chunks []io.Reader
+		start  int64
+	)
+
+	for i := 1; i < k; i++ {
+		// a boundary right after a newline is kept as is.
+		end, err := nextLine(r, max(start, size*int64(i)/int64(k)-1), size)
+		if err != nil {
+			return nil, err
+		}
+
+		if end >= size {
+			break
+		}
+
+		chunks = append(chunks, io.NewSectionReader(r, start, end-start))
+		start = end
+	}
+
+	return append(chunks, io.NewSectionReader(r, start, size-start)), nil
+}
+
+// nextLine returns the offset of the line following the one at offset, or
+// size if offset is within the last line.
+func nextLine(r io.ReaderAt, offset, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for offset < size {
+		n, err := r.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+
+		offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("ReadAt: %w", err)
+		}
+	}
+
+	return size, nil
+}
@@ -0,0 +1,74 @@
+package io
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	var lines []string
+	for i := range 1000 {
+		lines = append(lines, fmt.Sprintf("%x", i*i*i))
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+
+	for _, k := range []int{1, 2, 3, 7, 64, 5000} {
+		chunks, err := split(bytes.NewReader(data), int64(len(data)), k)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(chunks), k)
+
+		// the chunks hold whole lines, and all of them once.
+		var joined []byte
+		for i, chunk := range chunks {
+			b, err := io.ReadAll(chunk)
+			require.NoError(t, err)
+			require.NotEmpty(t, b)
+			if i < len(chunks)-1 {
+				require.Equal(t, byte('\n'), b[len(b)-1], "chunk %d of %d must end with a newline", i, k)
+			}
+			joined = append(joined, b...)
+		}
+		require.Equal(t, data, joined)
+	}
+}
+
+func TestSplit_NoTrailingNewline(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("aaaa\nbbbb\ncccc")
+	chunks, err := split(bytes.NewReader(data), int64(len(data)), 3)
+	require.NoError(t, err)
+
+	var got []string
+	for _, chunk := range chunks {
+		b, err := io.ReadAll(chunk)
+		require.NoError(t, err)
+		got = append(got, string(b))
+	}
+	require.Equal(t, []string{"aaaa\n", "bbbb\n", "cccc"}, got)
+}
+
+func TestSplit_Readers(t *testing.T) {
+	t.Parallel()
+
+	// small files and other readers are not split.
+	path := filepath.Join(t.TempDir(), "ids.csv")
+	require.NoError(t, os.WriteFile(path, []byte("a\nb\n"), 0600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	other := bytes.NewBufferString("c\n")
+	chunks, err := Split([]io.Reader{f, other}, 8)
+	require.NoError(t, err)
+	require.Equal(t, []io.Reader{f, other}, chunks)
+}
@@ -1,16 +1,16 @@
 package keys
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gtank/ristretto255"
 	"github.com/optable/match/pkg/pair"
-
-	// Register the SHA256 hash function
-	_ "crypto/sha256"
 )
 
 const mode = pair.PAIRSHA256Ristretto255
@@ -64,3 +64,21 @@ func hashSaltFromString(s string) ([]byte, error) {
 
 	return salt, nil
 }
+
+// Fingerprint returns a fingerprint of the private key which does not reveal
+// it: the first 16 bytes of the SHA256 hash of the public element, in hex.
+func Fingerprint(privateKey string) (string, error) {
+	b, err := privateKeyFromString(mode, privateKey)
+	if err != nil {
+		return "", fmt.Errorf("PrivateKeyFromString: %w", err)
+	}
+
+	sk := ristretto255.NewScalar()
+	if err := sk.UnmarshalText(b); err != nil {
+		return "", fmt.Errorf("ristretto255.UnmarshalText: %w", err)
+	}
+
+	pk := ristretto255.NewElement().ScalarBaseMult(sk)
+	sum := sha256.Sum256(pk.Encode(nil))
+	return hex.EncodeToString(sum[:16]), nil
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	namespace       = "opair"
+	shutdownTimeout = 5 * time.Second
+)
+
+// Directions of the bytes transferred to and from the storage.
+const (
+	DirectionRead  = "read"
+	DirectionWrite = "write"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// IDsRead counts the IDs read by PAIR operation.
+	IDsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ids_read_total",
+		Help:      "Number of IDs read, by PAIR operation.",
+	}, []string{"operation"})
+
+	// IDsWritten counts the IDs written by PAIR operation.
+	IDsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ids_written_total",
+		Help:      "Number of IDs written, by PAIR operation.",
+	}, []string{"operation"})
+
+	// Batches counts the batches of IDs processed by PAIR operation.
+	Batches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "batches_processed_total",
+		Help:      "Number of batches of IDs processed, by PAIR operation.",
+	}, []string{"operation"})
+
+	// Workers is the number of workers of the running PAIR operations.
+	Workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers",
+		Help:      "Number of workers of the running PAIR operation.",
+	}, []string{"operation"})
+
+	// BusyWorkers is the number of workers processing a batch of IDs. Divided by
+	// Workers, it gives the utilization of the workers.
+	BusyWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_busy",
+		Help:      "Number of workers processing a batch of IDs, by PAIR operation.",
+	}, []string{"operation"})
+
+	// StorageBytes counts the bytes read from and written to the storage of
+	// the PAIR data, be it GCS, S3, Azure Blob Storage or a local folder.
+	StorageBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_bytes_total",
+		Help:      "Number of bytes transferred to and from the storage, by direction.",
+	}, []string{"direction"})
+
+	// APIRequestDuration observes the latency of the calls to the clean room API.
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of the calls to the clean room API, by path and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path", "code"})
+
+	// StepDuration observes the duration of the steps of the PAIR protocol.
+	StepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "step_duration_seconds",
+		Help:      "Duration of the steps of the PAIR protocol, by step and status.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"step", "status"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		IDsRead,
+		IDsWritten,
+		Batches,
+		Workers,
+		BusyWorkers,
+		StorageBytes,
+		APIRequestDuration,
+		StepDuration,
+	)
+}
+
+// Handler returns the HTTP handler serving the Prometheus metrics on /metrics
+// and the runtime profiles on /debug/pprof.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// Serve listens on the given address and serves the metrics and profiles in
+// the background. The returned function shuts the server down.
+func Serve(ctx context.Context, addr string) (func(), error) {
+	logger := zerolog.Ctx(ctx)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:           Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+
+	logger.Debug().Msgf("serving metrics on http://%s/metrics", listener.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("failed to shut down metrics server")
+		}
+	}, nil
+}
+
+type (
+	readCloser struct {
+		io.ReadCloser
+		counter prometheus.Counter
+	}
+
+	writeCloser struct {
+		io.WriteCloser
+		counter prometheus.Counter
+	}
+)
+
+// StorageReader wraps a reader of a stored object to count the bytes read from the storage.
+func StorageReader(r io.ReadCloser) io.ReadCloser {
+	return &readCloser{ReadCloser: r, counter: StorageBytes.WithLabelValues(DirectionRead)}
+}
+
+// StorageWriter wraps a writer of a stored object to count the bytes written to the storage.
+func StorageWriter(w io.WriteCloser) io.WriteCloser {
+	return &writeCloser{WriteCloser: w, counter: StorageBytes.WithLabelValues(DirectionWrite)}
+}
+
+func (r *readCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+func (w *writeCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	shutdown, err := Serve(context.Background(), "127.0.0.1:0")
+	require.NoError(t, err)
+	defer shutdown()
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	r := StorageReader(io.NopCloser(strings.NewReader("hello")))
+	_, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: Handler()}
+	shutdown, addr := requireServe(t, server)
+	defer shutdown()
+
+	body := requireGet(t, fmt.Sprintf("http://%s/metrics", addr))
+	require.Contains(t, body, `opair_storage_bytes_total{direction="read"}`)
+
+	body = requireGet(t, fmt.Sprintf("http://%s/debug/pprof/", addr))
+	require.Contains(t, body, "goroutine")
+}
+
+func requireServe(t *testing.T, server *http.Server) (func(), string) {
+	t.Helper()
+
+	listener, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return func() { _ = server.Close() }, listener.Addr().String()
+}
+
+func requireGet(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
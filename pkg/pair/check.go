@@ -0,0 +1,55 @@
+package pair
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/gtank/ristretto255"
+	"golang.org/x/sync/errgroup"
+)
+
+// IDCheck is the result of CheckPAIRIDs: the number of rows read, and how
+// many of them are not encrypted PAIR IDs, i.e. valid Ristretto255 points.
+type IDCheck struct {
+	Rows    uint64
+	Invalid uint64
+}
+
+// CheckPAIRIDs reads the encrypted PAIR IDs of the sources concurrently,
+// counting the rows and the ones which do not decode as Ristretto255 points.
+func CheckPAIRIDs(ctx context.Context, sources []io.Reader) (IDCheck, error) {
+	var rows, invalid atomic.Uint64
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for _, source := range sources {
+		g.Go(func() error {
+			r := csv.NewReader(source)
+			element := ristretto255.NewElement()
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				record, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				rows.Add(1)
+				if err := element.UnmarshalText([]byte(record[0])); err != nil {
+					invalid.Add(1)
+				}
+			}
+		})
+	}
+
+	err := g.Wait()
+	return IDCheck{Rows: rows.Load(), Invalid: invalid.Load()}, err
+}
@@ -0,0 +1,32 @@
+package pair
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPAIRIDs(t *testing.T) {
+	t.Parallel()
+	// arrange
+	emails := requireGenRandomHashedEmails(t, 100)
+	encrypted := requireEncryptEmails(t, emails, requireGenSalt(t), requireGenKey(t))
+
+	valid := bytes.NewBuffer(nil)
+	requireWriteEmails(t, valid, encrypted)
+
+	// hashed emails are not encrypted, and neither are truncated PAIR IDs.
+	invalid := bytes.NewBuffer(nil)
+	requireWriteEmails(t, invalid, append(emails[:2], encrypted[0][:10]))
+
+	// act
+	check, err := CheckPAIRIDs(context.Background(), []io.Reader{valid, invalid, strings.NewReader("")})
+
+	// assert
+	require.NoError(t, err, "must check PAIR IDs")
+	require.Equal(t, IDCheck{Rows: 103, Invalid: 3}, check)
+}
@@ -7,17 +7,24 @@ import (
 	"fmt"
 	"optable-pair-cli/pkg/io"
 	"optable-pair-cli/pkg/keys"
+	"optable-pair-cli/pkg/metrics"
+	"optable-pair-cli/pkg/tracing"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 )
 
+// operationMatch labels the metrics of the match, alongside the PAIR operations.
+const operationMatch = "Match"
+
 type (
 	Matcher struct {
 		reader      *pairIDReader
@@ -29,7 +36,9 @@ type (
 
 	writer struct {
 		path    string
+		mu      sync.Mutex // guards writers and paths, opened concurrently by the workers
 		writers []io.WriteCloser
+		paths   []string
 		written atomic.Uint64
 	}
 )
@@ -39,7 +48,7 @@ func NewMatcher(adv, pub []io.Reader, out string) (*Matcher, error) {
 
 	m := &Matcher{
 		reader: &pairIDReader{
-			r:         csv.NewReader(io.MultiReader(pub...)),
+			sources:   pub,
 			batchSize: batchSize,
 			batch:     make(chan [][]byte, batchSize),
 			cancel:    cancel,
@@ -106,12 +115,17 @@ func (w *writer) NewWriter(index int) (*csv.Writer, error) {
 	}
 
 	p := strings.TrimRight(w.path, string(filepath.Separator))
-	f, err := os.Create(filepath.Join(p, fmt.Sprintf("result_%d.csv", index)))
+	name := filepath.Join(p, fmt.Sprintf("result_%d.csv", index))
+	f, err := os.Create(name)
 	if err != nil {
 		return nil, err
 	}
 
+	w.mu.Lock()
 	w.writers = append(w.writers, f)
+	w.paths = append(w.paths, name)
+	w.mu.Unlock()
+
 	return csv.NewWriter(f), nil
 }
 
@@ -125,10 +139,21 @@ func (w *writer) Close() error {
 	return nil
 }
 
-func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey string) error {
-	// Cancel the context when the operation needs more than an 4 hours
-	ctx, cancel := context.WithTimeout(ctx, maxOperationRunTime)
-	defer cancel()
+func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey string) (err error) {
+	ctx, span := tracing.Start(ctx, "pair."+operationMatch)
+	ctx = zerolog.Ctx(ctx).With().Str("operation", operationMatch).Logger().WithContext(ctx)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = interrupted(ctx, operationMatch, m.advRead.Load()+m.reader.read.Load())
+		}
+		span.SetAttributes(
+			attribute.Int("workers", numWorkers),
+			attribute.Int64("advertiser_rows_read", int64(m.advRead.Load())),
+			attribute.Int64("publisher_rows_read", int64(m.reader.read.Load())),
+			attribute.Int64("rows_written", int64(m.writer.written.Load())),
+		)
+		tracing.End(span, err)
+	}()
 
 	var (
 		logger        = zerolog.Ctx(ctx)
@@ -147,29 +172,52 @@ func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey st
 		return fmt.Errorf("NewPAIRPrivateKey: %w", err)
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	var (
+		idsRead    = metrics.IDsRead.WithLabelValues(operationMatch)
+		idsWritten = metrics.IDsWritten.WithLabelValues(operationMatch)
+		batches    = metrics.Batches.WithLabelValues(operationMatch)
+		workers    = metrics.Workers.WithLabelValues(operationMatch)
+	)
+
+	idsRead.Add(float64(m.advRead.Load()))
+	workers.Set(float64(numWorkers))
+	defer workers.Set(0)
+
+	g, gctx := errgroup.WithContext(ctx)
 
 	// producer
 	g.Go(func() error {
 		defer close(m.intersected)
 
-		for batchedIDs := range m.reader.batch {
+		for {
+			var (
+				batchedIDs [][]byte
+				ok         bool
+			)
 			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-				for _, id := range batchedIDs {
-					if _, ok := m.hashMap[string(id)]; ok {
-						// remove from map, so it won't be matched again
-						delete(m.hashMap, string(id))
-						// send to consumer
-						m.intersected <- id
+			case <-gctx.Done():
+				return gctx.Err()
+			case batchedIDs, ok = <-m.reader.batch:
+			}
+			if !ok {
+				return nil
+			}
+
+			idsRead.Add(float64(len(batchedIDs)))
+			batches.Inc()
+			for _, id := range batchedIDs {
+				if _, ok := m.hashMap[string(id)]; ok {
+					// remove from map, so it won't be matched again
+					delete(m.hashMap, string(id))
+					// send to consumer, unless they stopped on the end of the context
+					select {
+					case m.intersected <- id:
+					case <-gctx.Done():
+						return gctx.Err()
 					}
 				}
 			}
 		}
-
-		return nil
 	})
 
 	// consumer
@@ -183,8 +231,10 @@ func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey st
 
 			for matched := range m.intersected {
 				select {
-				case <-ctx.Done():
-					return ctx.Err()
+				case <-gctx.Done():
+					// keep the IDs decrypted so far, e.g. when interrupted.
+					w.Flush()
+					return gctx.Err()
 				default:
 					decrypted, err := pk.Decrypt(matched)
 					if err != nil {
@@ -195,6 +245,7 @@ func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey st
 						return err
 					}
 					m.writer.written.Add(1)
+					idsWritten.Inc()
 				}
 			}
 
@@ -205,6 +256,7 @@ func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey st
 	}
 
 	if err := g.Wait(); err != nil {
+		_ = m.writer.Close()
 		return err
 	}
 
@@ -214,11 +266,47 @@ func (m *Matcher) Match(ctx context.Context, numWorkers int, salt, privateKey st
 
 	logger.Debug().Msgf("Match: read %d advertiser and %d publisher IDs, written %d PAIR IDs in %s", m.advRead.Load(), m.reader.read.Load(), m.writer.written.Load(), time.Since(startTime))
 
-	logger.Info().Msgf("Matched %.2f percent triple encrypted PAIR IDs, decrypted PAIR IDs are written to %s", normalizedMatchRate(int(m.writer.written.Load()), int(m.advRead.Load())), m.writer.path)
+	logger.Info().Msgf("Matched %.2f percent triple encrypted PAIR IDs, decrypted PAIR IDs are written to %s", m.MatchRate(), m.writer.path)
 
 	return m.writer.Close()
 }
 
+// RemoveResults closes and removes the result files written by Match, e.g.
+// when it fails as the data read is not trustworthy.
+func (m *Matcher) RemoveResults() error {
+	_ = m.writer.Close()
+
+	var errs []error
+	for _, p := range m.writer.paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	m.writer.paths = nil
+
+	return errors.Join(errs...)
+}
+
+// AdvertiserRowsRead returns the number of advertiser triple encrypted PAIR IDs read.
+func (m *Matcher) AdvertiserRowsRead() uint64 {
+	return m.advRead.Load()
+}
+
+// PublisherRowsRead returns the number of publisher triple encrypted PAIR IDs read so far.
+func (m *Matcher) PublisherRowsRead() uint64 {
+	return m.reader.read.Load()
+}
+
+// Matched returns the number of matched PAIR IDs written so far.
+func (m *Matcher) Matched() uint64 {
+	return m.writer.written.Load()
+}
+
+// MatchRate returns the percentage of advertiser PAIR IDs that were matched.
+func (m *Matcher) MatchRate() float64 {
+	return normalizedMatchRate(int(m.writer.written.Load()), int(m.advRead.Load()))
+}
+
 func normalizedMatchRate(matched, total int) float64 {
 	if total == 0 {
 		return 0
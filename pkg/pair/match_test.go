@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"optable-pair-cli/pkg/io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -149,3 +151,108 @@ func TestMatch_MultipleWorkers(t *testing.T) {
 
 	require.Equal(t, commoLen, matchRate, "must match 900 emails")
 }
+
+func TestMatch_DeadlineExceeded(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	salt := requireGenSalt(t)
+	publisherKey, advertiserKey := requireGenKey(t), requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, nEmails)
+	publisherEncryptedEmails := requireEncryptEmails(t, emails[:commonEnd], salt, publisherKey)
+	advertiserEncryptedEmails := requireEncryptEmails(t, emails[commonStart:], salt, advertiserKey)
+	publisherTwiceEncryptedEmails := requireReEncryptEmails(t, publisherEncryptedEmails, salt, advertiserKey)
+	advertiserTwiceEncryptedEmails := requireReEncryptEmails(t, advertiserEncryptedEmails, salt, publisherKey)
+	advertiserReader, publisherReader := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+
+	requireWriteEmails(t, publisherReader, publisherTwiceEncryptedEmails)
+	requireWriteEmails(t, advertiserReader, advertiserTwiceEncryptedEmails)
+
+	// the publisher data stalls once read, until the deadline is exceeded.
+	stall := make(chan struct{})
+	defer close(stall)
+
+	cause := fmt.Errorf("step3 timed out: %w", context.DeadlineExceeded)
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 500*time.Millisecond, cause)
+	defer cancel()
+
+	// act
+	matcher, err := NewMatcher([]io.Reader{advertiserReader}, []io.Reader{&stalledReader{r: publisherReader, stall: stall}}, t.TempDir())
+	require.NoError(t, err, "must create Matcher")
+
+	err = matcher.Match(ctx, 2, salt, advertiserKey)
+
+	// assert
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, cause)
+	require.Contains(t, err.Error(), "Match interrupted after processing")
+}
+
+func TestMatch_RemoveResults(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	ctx := context.Background()
+	salt := requireGenSalt(t)
+	publisherKey, advertiserKey := requireGenKey(t), requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, nEmails)
+	publisherEncryptedEmails := requireEncryptEmails(t, emails[:commonEnd], salt, publisherKey)
+	advertiserEncryptedEmails := requireEncryptEmails(t, emails[commonStart:], salt, advertiserKey)
+	publisherTwiceEncryptedEmails := requireReEncryptEmails(t, publisherEncryptedEmails, salt, advertiserKey)
+	advertiserTwiceEncryptedEmails := requireReEncryptEmails(t, advertiserEncryptedEmails, salt, publisherKey)
+	advertiserReader, publisherReader := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+
+	requireWriteEmails(t, publisherReader, publisherTwiceEncryptedEmails)
+	requireWriteEmails(t, advertiserReader, advertiserTwiceEncryptedEmails)
+
+	// the publisher data fails once read entirely.
+	errRead := errors.New("publisher data altered")
+	dir := t.TempDir()
+
+	// act
+	matcher, err := NewMatcher([]io.Reader{advertiserReader}, []io.Reader{&failingReader{r: publisherReader, err: errRead}}, dir)
+	require.NoError(t, err, "must create Matcher")
+
+	err = matcher.Match(ctx, 1, salt, advertiserKey)
+	require.ErrorIs(t, err, errRead)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "must write the result file")
+
+	// assert
+	require.NoError(t, matcher.RemoveResults())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "must remove the result files")
+}
+
+// failingReader reads r, then returns err instead of EOF.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+
+	return n, err
+}
+
+// stalledReader reads r, then blocks until stall is closed instead of returning EOF.
+type stalledReader struct {
+	r     io.Reader
+	stall <-chan struct{}
+}
+
+func (s *stalledReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		<-s.stall
+	}
+
+	return n, err
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"optable-pair-cli/pkg/keys"
+	"optable-pair-cli/pkg/metrics"
+	"optable-pair-cli/pkg/tracing"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -14,14 +16,15 @@ import (
 
 	"github.com/optable/match/pkg/pair"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	batchSize      = 1024
-	minimumIDCount = 1000
+	batchSize = 1024
 
-	maxOperationRunTime = 4 * time.Hour
+	// MinimumIDCount is the minimum number of identifiers for a secure PAIR ID match.
+	MinimumIDCount = 1000
 
 	SHA256SaltSize = 32
 )
@@ -32,14 +35,14 @@ var (
 
 type (
 	IDReadWriter struct {
-		reader    *pairIDReader
-		w         *csv.Writer
-		writeLock *sync.Mutex
-		written   atomic.Uint64
+		reader *pairIDReader
+		// ws are written concurrently, each by its own writer.
+		ws      []*csv.Writer
+		written atomic.Uint64
 	}
 
 	pairIDReader struct {
-		r         *csv.Reader
+		sources   []io.Reader
 		read      atomic.Uint64
 		batchSize int
 		batch     chan [][]byte
@@ -48,7 +51,8 @@ type (
 	}
 
 	readWriterOption struct {
-		secondaryWriter io.Writer
+		secondaryWriter   io.Writer
+		concurrentWriters []io.Writer
 	}
 
 	ReadWriterOption func(*readWriterOption)
@@ -60,6 +64,16 @@ func WithSecondaryWriter(w io.Writer) ReadWriterOption {
 	}
 }
 
+// WithConcurrentWriters makes the IDReadWriter write the PAIR IDs to ws as
+// well, each concurrently with the others by its own writer: every batch of
+// PAIR IDs is written to one of the writers. It can not be combined with a
+// secondary writer.
+func WithConcurrentWriters(ws ...io.Writer) ReadWriterOption {
+	return func(o *readWriterOption) {
+		o.concurrentWriters = ws
+	}
+}
+
 type Operation uint8
 
 const (
@@ -81,28 +95,33 @@ func (p Operation) String() string {
 	}
 }
 
-type pairOps struct {
-	do      func([]byte) ([]byte, error)
-	shuffle bool
-}
-
-func NewPAIRIDReadWriter(r io.Reader, w io.Writer, opts ...ReadWriterOption) (*IDReadWriter, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
+// NewPAIRIDReadWriter returns an IDReadWriter reading identifiers from the
+// readers, which are parsed concurrently, and writing PAIR IDs to w, and to the
+// concurrent writers if any.
+func NewPAIRIDReadWriter(rs []io.Reader, w io.Writer, opts ...ReadWriterOption) (*IDReadWriter, error) {
 	rwOpt := &readWriterOption{}
 	for _, opt := range opts {
 		opt(rwOpt)
 	}
 
 	if rwOpt.secondaryWriter != nil {
+		if len(rwOpt.concurrentWriters) > 0 {
+			return nil, errors.New("a secondary writer can not be combined with concurrent writers")
+		}
 		w = io.MultiWriter(w, rwOpt.secondaryWriter)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ws := []*csv.Writer{csv.NewWriter(w)}
+	for _, cw := range rwOpt.concurrentWriters {
+		ws = append(ws, csv.NewWriter(cw))
+	}
+
 	p := &IDReadWriter{
-		w:         csv.NewWriter(w),
-		writeLock: &sync.Mutex{},
+		ws: ws,
 		reader: &pairIDReader{
-			r:         csv.NewReader(r),
+			sources:   rs,
 			batchSize: batchSize,
 			batch:     make(chan [][]byte, batchSize),
 			cancel:    cancel,
@@ -119,46 +138,76 @@ func NewPAIRIDReadWriter(r io.Reader, w io.Writer, opts ...ReadWriterOption) (*I
 	return p, nil
 }
 
+// readPAIRIDs parses the sources concurrently, sending their IDs in batches
+// to p.batch, which is closed once all of them are read.
 func readPAIRIDs(ctx context.Context, p *pairIDReader) {
 	defer close(p.batch)
 	defer p.cancel()
 
-	batch := 0
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for _, source := range p.sources {
+		g.Go(func() error {
+			return p.parse(ctx, csv.NewReader(source))
+		})
+	}
+
+	p.err = io.EOF
+	if err := g.Wait(); err != nil {
+		p.err = err
+	}
+}
+
+// parse reads the IDs of r, sending them in batches to p.batch.
+func (p *pairIDReader) parse(ctx context.Context, r *csv.Reader) error {
 	ids := make([][]byte, 0, p.batchSize)
 	for {
-		record, err := p.r.Read()
+		record, err := r.Read()
 		if errors.Is(err, io.EOF) {
-			p.err = io.EOF
-			// Write the last batch
-			if len(ids) > 0 {
-				p.batch <- ids
-				p.read.Add(uint64(len(ids)))
-			}
-
-			return
+			break
 		} else if err != nil {
-			p.err = err
-			return
+			return err
 		}
 
 		// Input should have only one id column
 		ids = append(ids, []byte(record[0]))
-		batch++
 
 		// sent a full batch of records to the channel.
-		if batch == batchSize {
-			select {
-			case <-ctx.Done():
-				p.err = ctx.Err()
-				return
-			case p.batch <- ids:
-				// reset the batch
-				ids = make([][]byte, 0, batchSize)
-				batch = 0
-				p.read.Add(uint64(batchSize))
+		if len(ids) == p.batchSize {
+			if err := p.send(ctx, ids); err != nil {
+				return err
 			}
+			ids = make([][]byte, 0, p.batchSize)
 		}
 	}
+
+	// Write the last batch
+	if len(ids) > 0 {
+		return p.send(ctx, ids)
+	}
+
+	return nil
+}
+
+// send sends a batch of IDs to p.batch, counting them as read.
+func (p *pairIDReader) send(ctx context.Context, ids [][]byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case p.batch <- ids:
+		p.read.Add(uint64(len(ids)))
+		return nil
+	}
+}
+
+// RowsRead returns the number of IDs read so far.
+func (p *IDReadWriter) RowsRead() uint64 {
+	return p.reader.read.Load()
+}
+
+// RowsWritten returns the number of PAIR IDs written so far.
+func (p *IDReadWriter) RowsWritten() uint64 {
+	return p.written.Load()
 }
 
 func (p *IDReadWriter) HashEncrypt(ctx context.Context, numWorkers int, salt, privateKey string) error {
@@ -173,128 +222,229 @@ func (p *IDReadWriter) Decrypt(ctx context.Context, numWorkers int, salt, privat
 	return runPAIROperation(ctx, p, numWorkers, salt, privateKey, OperationDecrypt)
 }
 
-func runPAIROperation(ctx context.Context, p *IDReadWriter, numWorkers int, salt, privateKey string, op Operation) error {
-	// Cancel the context when the operation needs more than an 4 hours
-	ctx, cancel := context.WithTimeout(ctx, maxOperationRunTime)
-	defer cancel()
+// runPAIROperation runs the operation until the input is exhausted or the
+// context is done, e.g. when the deadline of the step or the command is exceeded.
+//
+// The batches of IDs read are processed by a fixed pool of numWorkers workers,
+// each with its own parsed key, and the resulting batches of PAIR IDs are
+// written by a single writer, or one writer per concurrent writer. The
+// operation returns once all of them are done.
+func runPAIROperation(ctx context.Context, p *IDReadWriter, numWorkers int, salt, privateKey string, op Operation) (err error) {
+	ctx, span := tracing.Start(ctx, "pair."+op.String())
+	ctx = zerolog.Ctx(ctx).With().Str("operation", op.String()).Logger().WithContext(ctx)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = interrupted(ctx, op.String(), p.reader.read.Load())
+		}
+		span.SetAttributes(
+			attribute.Int("workers", numWorkers),
+			attribute.Int64("rows_read", int64(p.reader.read.Load())),
+			attribute.Int64("rows_written", int64(p.written.Load())),
+		)
+		tracing.End(span, err)
+	}()
+
+	// stop reading once the operation is done, e.g. on error.
+	defer p.reader.cancel()
 
 	var (
 		logger     = zerolog.Ctx(ctx)
 		startTime  = time.Now()
-		done       = make(chan struct{}, 1)
-		errChan    = make(chan error, 1)
-		once       sync.Once
 		maxWorkers = runtime.GOMAXPROCS(0)
-		operation  = &pairOps{}
 	)
 
-	// Limit the number of workers to 8
 	if numWorkers > maxWorkers {
 		numWorkers = maxWorkers
 		logger.Warn().Msgf("Number of workers is limited to %d", numWorkers)
 	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(numWorkers)
+	workers := metrics.Workers.WithLabelValues(op.String())
+	workers.Set(float64(numWorkers))
+	defer workers.Set(0)
+
+	var (
+		g, gctx = errgroup.WithContext(ctx)
+		// batches of PAIR IDs from the workers to the writers.
+		results = make(chan []string, numWorkers)
+		// batches written, recycled by the workers.
+		free = make(chan []string, 2*numWorkers)
+		wg   sync.WaitGroup
+	)
+
+	for range numWorkers {
+		wg.Add(1)
+		g.Go(func() error {
+			defer wg.Done()
+			return p.work(gctx, op, salt, privateKey, results, free)
+		})
+	}
+
+	g.Go(func() error {
+		// the writers stop once all the workers are done.
+		wg.Wait()
+		close(results)
+		return nil
+	})
+
+	for _, w := range p.ws {
+		g.Go(func() error {
+			return p.write(gctx, op, w, results, free)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if !errors.Is(p.reader.err, io.EOF) {
+		return fmt.Errorf("read: %w", p.reader.err)
+	}
+
+	if p.reader.read.Load() < MinimumIDCount {
+		return ErrInputBelowThreshold
+	}
+
+	logger.Debug().Msgf("%s: read %d IDs, written %d PAIR IDs in %s", op, p.reader.read.Load(), p.written.Load(), time.Since(startTime))
+	return nil
+}
+
+// apply returns the function applying the operation with the key.
+func (op Operation) apply(pk *pair.PrivateKey) (func([]byte) ([]byte, error), error) {
+	switch op {
+	case OperationHashEncrypt:
+		return pk.Encrypt, nil
+	case OperationReEncrypt:
+		return pk.ReEncrypt, nil
+	case OperationDecrypt:
+		return pk.Decrypt, nil
+	default:
+		return nil, fmt.Errorf("invalid operation %d", op)
+	}
+}
+
+// work runs the operation on the batches of IDs read, until the input is
+// exhausted or the context is done, and sends the resulting batches of
+// PAIR IDs to the writer. The batches are taken from free when available.
+func (p *IDReadWriter) work(ctx context.Context, op Operation, salt, privateKey string, results chan<- []string, free <-chan []string) error {
+	pk, err := keys.NewPAIRPrivateKey(salt, privateKey)
+	if err != nil {
+		return fmt.Errorf("NewPAIRPrivateKey: %w", err)
+	}
+
+	do, err := op.apply(pk)
+	if err != nil {
+		return err
+	}
+
+	var (
+		busy    = metrics.BusyWorkers.WithLabelValues(op.String())
+		idsRead = metrics.IDsRead.WithLabelValues(op.String())
+	)
 
 	for {
+		var (
+			ids [][]byte
+			ok  bool
+		)
 		select {
-		case err := <-errChan:
-			close(done)
-			close(errChan)
-			return err
-		case <-done:
-			if err := g.Wait(); err != nil {
-				return fmt.Errorf("g.Wait: %w", err)
-			}
-			close(done)
+		case <-ctx.Done():
+			return ctx.Err()
+		case ids, ok = <-p.reader.batch:
+		}
+		if !ok {
+			return nil
+		}
 
-			if p.reader.read.Load() < minimumIDCount {
-				return ErrInputBelowThreshold
-			}
+		var pairIDs []string
+		select {
+		case pairIDs = <-free:
+		default:
+			pairIDs = make([]string, 0, batchSize)
+		}
 
-			logger.Debug().Msgf("%s: read %d IDs, written %d PAIR IDs in %s", op, p.reader.read.Load(), p.written.Load(), time.Since(startTime))
-			return nil
+		busy.Inc()
+		pairIDs, err = operate(do, op == OperationReEncrypt, ids, pairIDs)
+		busy.Dec()
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		idsRead.Add(float64(len(ids)))
+
+		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-			g.Go(func() error {
-				pk, err := keys.NewPAIRPrivateKey(salt, privateKey)
-				if err != nil {
-					err := fmt.Errorf("NewPAIRPrivateKey: %w", err)
-					errChan <- err
-					return err
-				}
-
-				switch op {
-				case OperationHashEncrypt:
-					operation.do = pk.Encrypt
-				case OperationReEncrypt:
-					operation.do = pk.ReEncrypt
-					operation.shuffle = true
-				case OperationDecrypt:
-					operation.do = pk.Decrypt
-				default:
-					err := errors.New("invalid operation")
-					errChan <- err
-					return err
-				}
-
-				if err := p.operate(operation); err != nil {
-					if errors.Is(err, io.EOF) {
-						once.Do(func() {
-							done <- struct{}{}
-						})
-						return nil
-					}
-
-					err := fmt.Errorf("p.Operate: %w", err)
-					errChan <- err
-					return err
-				}
-
-				return nil
-			})
+		case results <- pairIDs:
 		}
 	}
 }
 
-// operate reads a batch of records from the input reader,
-// runs the PAIR operation on the records and writes to the underlying writer.
-func (p *IDReadWriter) operate(op *pairOps) error {
-	ids, ok := <-p.reader.batch
-	if !ok {
-		return p.reader.err
-	}
-
+// operate applies the operation to the batch of IDs and appends the resulting PAIR IDs to pairIDs.
+func operate(do func([]byte) ([]byte, error), shuffle bool, ids [][]byte, pairIDs []string) ([]string, error) {
 	// Shuffle the ids in place before processing
 	// Note that we already receive the batch of IDs
 	// in a pseudo-random order from the reader.
-	if op.shuffle {
+	if shuffle {
 		pair.Shuffle(ids)
 	}
 
-	records := make([][]string, 0, len(ids))
 	for _, id := range ids {
-		pairID, err := op.do(id)
+		pairID, err := do(id)
 		if err != nil {
-			return fmt.Errorf("encrypt: %w", err)
+			return nil, err
 		}
 
-		records = append(records, []string{string(pairID)})
+		pairIDs = append(pairIDs, string(pairID))
 	}
 
-	// write is not thread safe
-	p.writeLock.Lock()
-	defer p.writeLock.Unlock()
-	if err := p.w.WriteAll(records); err != nil {
-		return fmt.Errorf("w.WriteAll: %w", err)
-	}
-	p.written.Add(uint64(len(records)))
+	return pairIDs, nil
+}
+
+// write writes the batches of PAIR IDs sent by the workers to w until they are
+// all done, and hands the batches written back to them through free.
+func (p *IDReadWriter) write(ctx context.Context, op Operation, w *csv.Writer, results <-chan []string, free chan<- []string) error {
+	var (
+		idsWritten = metrics.IDsWritten.WithLabelValues(op.String())
+		batches    = metrics.Batches.WithLabelValues(op.String())
+		record     = make([]string, 1)
+	)
 
-	if err := p.w.Error(); err != nil {
-		return fmt.Errorf("p.w.Error: %w", err)
+	for pairIDs := range results {
+		if ctx.Err() != nil {
+			// drain the batches left by the workers stopped on the end of the context.
+			continue
+		}
+
+		for _, pairID := range pairIDs {
+			record[0] = pairID
+			if err := w.Write(record); err != nil {
+				return fmt.Errorf("w.Write: %w", err)
+			}
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("w.Flush: %w", err)
+		}
+
+		p.written.Add(uint64(len(pairIDs)))
+		idsWritten.Add(float64(len(pairIDs)))
+		batches.Inc()
+
+		select {
+		case free <- pairIDs[:0]:
+		default:
+		}
 	}
 
 	return nil
 }
+
+// interrupted returns the error of an operation interrupted by the end of its
+// context, with the number of rows processed so far. It wraps the cause of the
+// end of the context, such as the deadline exceeded.
+func interrupted(ctx context.Context, op string, rows uint64) error {
+	return fmt.Errorf("%s interrupted after processing %d rows: %w", op, rows, context.Cause(ctx))
+}
@@ -7,10 +7,13 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"optable-pair-cli/pkg/keys"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/optable/match/pkg/pair"
 	"github.com/stretchr/testify/require"
@@ -31,7 +34,7 @@ func TestPAIRIDReadWriter_HashEncrypt(t *testing.T) {
 	requireWriteEmails(t, r, emails)
 
 	// act
-	rw, err := NewPAIRIDReadWriter(r, w)
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 	require.NoError(t, err, "must create PAIRIDReadWriter")
 
 	err = rw.HashEncrypt(ctx, 1, salt, key)
@@ -49,6 +52,86 @@ func TestPAIRIDReadWriter_HashEncrypt(t *testing.T) {
 	}
 }
 
+func TestPAIRIDReadWriter_MultipleSources(t *testing.T) {
+	t.Parallel()
+	// arrange
+	lenEmails := 5000
+	ctx := context.Background()
+	salt := requireGenSalt(t)
+	key := requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, lenEmails)
+	expected := requireEncryptEmails(t, emails, salt, key)
+	w := bytes.NewBuffer(nil)
+
+	// spread the emails unevenly over several sources, parsed concurrently
+	var sources []io.Reader
+	for _, bounds := range [][2]int{{0, 1}, {1, 2500}, {2500, 2500}, {2500, lenEmails}} {
+		r := bytes.NewBuffer(nil)
+		requireWriteEmails(t, r, emails[bounds[0]:bounds[1]])
+		sources = append(sources, r)
+	}
+
+	// act
+	rw, err := NewPAIRIDReadWriter(sources, w)
+	require.NoError(t, err, "must create PAIRIDReadWriter")
+
+	err = rw.HashEncrypt(ctx, 2, salt, key)
+	require.NoError(t, err, "must hash and encrypt emails")
+
+	// assert
+	require.Equal(t, uint64(lenEmails), rw.RowsRead(), "must count all rows read")
+	require.Equal(t, uint64(lenEmails), rw.RowsWritten(), "must count all rows written")
+
+	hashEncryptedData, err := csv.NewReader(w).ReadAll()
+	require.NoError(t, err, "must read csv data")
+
+	got := make([]string, 0, len(hashEncryptedData))
+	for _, hashEncrypted := range hashEncryptedData {
+		require.Len(t, hashEncrypted, 1, "must contain one csv column")
+		got = append(got, hashEncrypted[0])
+	}
+	require.ElementsMatch(t, expected, got, "must encrypt the emails of all sources")
+}
+
+func TestPAIRIDReadWriter_ConcurrentWriters(t *testing.T) {
+	t.Parallel()
+	// arrange
+	lenEmails := 5000
+	ctx := context.Background()
+	salt := requireGenSalt(t)
+	key := requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, lenEmails)
+	expected := requireEncryptEmails(t, emails, salt, key)
+	r := bytes.NewBuffer(nil)
+	requireWriteEmails(t, r, emails)
+
+	ws := []*bytes.Buffer{bytes.NewBuffer(nil), bytes.NewBuffer(nil), bytes.NewBuffer(nil)}
+
+	// act
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, ws[0], WithConcurrentWriters(ws[1], ws[2]))
+	require.NoError(t, err, "must create PAIRIDReadWriter")
+
+	err = rw.HashEncrypt(ctx, 2, salt, key)
+	require.NoError(t, err, "must hash and encrypt emails")
+
+	// assert
+	require.Equal(t, uint64(lenEmails), rw.RowsWritten(), "must count all rows written")
+
+	var got []string
+	for _, w := range ws {
+		hashEncryptedData, err := csv.NewReader(w).ReadAll()
+		require.NoError(t, err, "must read csv data of each writer")
+		for _, hashEncrypted := range hashEncryptedData {
+			require.Len(t, hashEncrypted, 1, "must contain one csv column")
+			got = append(got, hashEncrypted[0])
+		}
+	}
+	require.ElementsMatch(t, expected, got, "must write every email to one of the writers")
+
+	_, err = NewPAIRIDReadWriter(nil, ws[0], WithConcurrentWriters(ws[1]), WithSecondaryWriter(ws[2]))
+	require.Error(t, err, "must not combine a secondary writer with concurrent writers")
+}
+
 func TestPAIRIDReadWriter_ReEncrypt(t *testing.T) {
 	t.Parallel()
 	// arrange
@@ -68,7 +151,7 @@ func TestPAIRIDReadWriter_ReEncrypt(t *testing.T) {
 	expected := twiceEncryptedEmails
 
 	// act
-	rw, err := NewPAIRIDReadWriter(r, w)
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 	require.NoError(t, err, "must create PAIRIDReadWriter")
 
 	err = rw.ReEncrypt(ctx, 1, salt, key)
@@ -123,7 +206,7 @@ func TestPAIRIDReadWriter_HashDecrypt(t *testing.T) {
 	expected := encryptedEmails
 
 	// act
-	rw, err := NewPAIRIDReadWriter(r, w)
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 	require.NoError(t, err, "must create PAIRIDReadWriter")
 
 	err = rw.Decrypt(ctx, 1, salt, key)
@@ -159,7 +242,7 @@ func TestPAIRIDReadWriter_InputBelowThreshold(t *testing.T) {
 		// set emails in csv format for PAIRIDReadWriter to read
 		requireWriteEmails(t, r, emails)
 
-		rw, err := NewPAIRIDReadWriter(r, w)
+		rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 		require.NoError(t, err, "must create PAIRIDReadWriter")
 
 		err = rw.HashEncrypt(ctx, 1, salt, key)
@@ -174,7 +257,7 @@ func TestPAIRIDReadWriter_InputBelowThreshold(t *testing.T) {
 		// set encrypted emails in csv format for PAIRIDReadWriter to read
 		requireWriteEmails(t, r, encryptedEmails)
 
-		rw, err := NewPAIRIDReadWriter(r, w)
+		rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 		require.NoError(t, err, "must create PAIRIDReadWriter")
 
 		err = rw.ReEncrypt(ctx, 1, salt, key)
@@ -189,7 +272,7 @@ func TestPAIRIDReadWriter_InputBelowThreshold(t *testing.T) {
 		// set twice encrypted emails in csv format for PAIRIDReadWriter to read
 		requireWriteEmails(t, r, twiceEncryptedEmails)
 
-		rw, err := NewPAIRIDReadWriter(r, w)
+		rw, err := NewPAIRIDReadWriter([]io.Reader{r}, w)
 		require.NoError(t, err, "must create PAIRIDReadWriter")
 
 		err = rw.Decrypt(ctx, 1, salt, key)
@@ -198,7 +281,108 @@ func TestPAIRIDReadWriter_InputBelowThreshold(t *testing.T) {
 	})
 }
 
-func requireGenRandomHashedEmails(t *testing.T, emailsCount int) []string {
+func TestPAIRIDReadWriter_DeadlineExceeded(t *testing.T) {
+	t.Parallel()
+	// arrange
+	lenEmails := 1500
+	salt := requireGenSalt(t)
+	key := requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, lenEmails)
+
+	// the input stalls once the emails are read, until the deadline is exceeded.
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		csvWriter := csv.NewWriter(w)
+		for _, email := range emails {
+			_ = csvWriter.Write([]string{email})
+		}
+		csvWriter.Flush()
+	}()
+
+	cause := fmt.Errorf("step1 timed out: %w", context.DeadlineExceeded)
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 500*time.Millisecond, cause)
+	defer cancel()
+
+	// act
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, io.Discard)
+	require.NoError(t, err, "must create PAIRIDReadWriter")
+
+	err = rw.HashEncrypt(ctx, 2, salt, key)
+
+	// assert
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, cause)
+	require.Contains(t, err.Error(), fmt.Sprintf("HashEncrypt interrupted after processing %d rows", rw.RowsRead()))
+}
+
+func TestPAIRIDReadWriter_WriteError(t *testing.T) {
+	t.Parallel()
+	// arrange
+	lenEmails := 4 * batchSize
+	ctx := context.Background()
+	salt := requireGenSalt(t)
+	key := requireGenKey(t)
+	emails := requireGenRandomHashedEmails(t, lenEmails)
+	r := bytes.NewBuffer(nil)
+	requireWriteEmails(t, r, emails)
+
+	// act
+	rw, err := NewPAIRIDReadWriter([]io.Reader{r}, failingWriter{})
+	require.NoError(t, err, "must create PAIRIDReadWriter")
+
+	err = rw.HashEncrypt(ctx, 4, salt, key)
+
+	// assert: the error of the writer stops the workers.
+	require.ErrorIs(t, err, errWrite)
+	require.Zero(t, rw.RowsWritten(), "must not count the rows not written")
+}
+
+var errWrite = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWrite
+}
+
+func BenchmarkPAIRIDReadWriter(b *testing.B) {
+	ctx := context.Background()
+	salt := requireGenSalt(b)
+	key := requireGenKey(b)
+	emails := requireGenRandomHashedEmails(b, 4*batchSize)
+	encryptedEmails := requireEncryptEmails(b, emails, salt, key)
+
+	hashed, encrypted := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	requireWriteEmails(b, hashed, emails)
+	requireWriteEmails(b, encrypted, encryptedEmails)
+
+	for _, op := range []Operation{OperationHashEncrypt, OperationReEncrypt, OperationDecrypt} {
+		input := encrypted.Bytes()
+		if op == OperationHashEncrypt {
+			input = hashed.Bytes()
+		}
+
+		for _, numWorkers := range []int{1, runtime.GOMAXPROCS(0)} {
+			b.Run(fmt.Sprintf("%s/workers=%d", op, numWorkers), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				b.ReportAllocs()
+
+				for range b.N {
+					rw, err := NewPAIRIDReadWriter([]io.Reader{bytes.NewReader(input)}, io.Discard)
+					require.NoError(b, err)
+
+					err = runPAIROperation(ctx, rw, numWorkers, salt, key, op)
+					require.NoError(b, err)
+				}
+
+				b.ReportMetric(float64(len(emails)*b.N)/b.Elapsed().Seconds(), "rows/s")
+			})
+		}
+	}
+}
+
+func requireGenRandomHashedEmails(t testing.TB, emailsCount int) []string {
 	t.Helper()
 	shaEncoder := sha256.New()
 	hems := make([]string, emailsCount)
@@ -210,7 +394,7 @@ func requireGenRandomHashedEmails(t *testing.T, emailsCount int) []string {
 	return hems
 }
 
-func requireWriteEmails(t *testing.T, w io.Writer, emails []string) {
+func requireWriteEmails(t testing.TB, w io.Writer, emails []string) {
 	csvWriter := csv.NewWriter(w)
 	for _, email := range emails {
 		err := csvWriter.Write([]string{email})
@@ -219,7 +403,7 @@ func requireWriteEmails(t *testing.T, w io.Writer, emails []string) {
 	csvWriter.Flush()
 }
 
-func requireEncryptEmails(t *testing.T, emails []string, salt, key string) []string {
+func requireEncryptEmails(t testing.TB, emails []string, salt, key string) []string {
 	t.Helper()
 	pk, err := keys.NewPAIRPrivateKey(salt, key)
 	require.NoError(t, err)
@@ -233,7 +417,7 @@ func requireEncryptEmails(t *testing.T, emails []string, salt, key string) []str
 	return encryptedEmails
 }
 
-func requireReEncryptEmails(t *testing.T, emails []string, salt, key string) []string {
+func requireReEncryptEmails(t testing.TB, emails []string, salt, key string) []string {
 	t.Helper()
 	pk, err := keys.NewPAIRPrivateKey(salt, key)
 	require.NoError(t, err)
@@ -247,7 +431,7 @@ func requireReEncryptEmails(t *testing.T, emails []string, salt, key string) []s
 	return encryptedEmails
 }
 
-func requireGenSalt(t *testing.T) string {
+func requireGenSalt(t testing.TB) string {
 	t.Helper()
 	salt := make([]byte, SHA256SaltSize)
 	_, err := rand.Read(salt)
@@ -255,7 +439,7 @@ func requireGenSalt(t *testing.T) string {
 	return base64.StdEncoding.EncodeToString(salt)
 }
 
-func requireGenKey(t *testing.T) string {
+func requireGenKey(t testing.TB) string {
 	t.Helper()
 	key, err := keys.NewPrivateKey(pair.PAIRSHA256Ristretto255)
 	require.NoError(t, err)
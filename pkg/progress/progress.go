@@ -0,0 +1,218 @@
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/rs/zerolog"
+)
+
+const (
+	barRefreshInterval = 500 * time.Millisecond
+	logInterval        = 30 * time.Second
+	barWidth           = 30
+)
+
+// Mode selects how progress is reported.
+type Mode string
+
+const (
+	// ModeAuto renders a progress bar when stderr is a terminal, and logs otherwise.
+	ModeAuto Mode = "auto"
+	// ModeBar renders a progress bar on stderr.
+	ModeBar Mode = "bar"
+	// ModeLog emits periodic log lines.
+	ModeLog Mode = "log"
+	// ModeNone disables progress reporting.
+	ModeNone Mode = "none"
+)
+
+type (
+	// Source returns the number of rows processed and bytes read so far.
+	// It is sampled periodically and must be safe for concurrent use.
+	Source func() (rows uint64, bytes int64)
+
+	// Reporter samples a Source and reports the progress of an operation until stopped.
+	Reporter struct {
+		mode       Mode
+		title      string
+		totalBytes int64
+		source     Source
+		out        io.Writer
+		startTime  time.Time
+		done       chan struct{}
+		wg         sync.WaitGroup
+		once       sync.Once
+	}
+
+	// sample is the progress of an operation at a point in time.
+	sample struct {
+		rows       uint64
+		bytes      int64
+		totalBytes int64
+		elapsed    time.Duration
+	}
+)
+
+// Start starts reporting the progress of the operation with the given title
+// in the background. totalBytes is the size of the input of the operation, used
+// to estimate the remaining time, or 0 if unknown. Stop must be called once the
+// operation is done.
+func Start(ctx context.Context, mode Mode, title string, totalBytes int64, source Source) *Reporter {
+	if mode == ModeAuto || mode == "" {
+		mode = ModeLog
+		if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
+			mode = ModeBar
+		}
+	}
+
+	r := &Reporter{
+		mode:       mode,
+		title:      title,
+		totalBytes: totalBytes,
+		source:     source,
+		out:        os.Stderr,
+		startTime:  time.Now(),
+		done:       make(chan struct{}),
+	}
+
+	switch mode {
+	case ModeBar:
+		r.wg.Add(1)
+		go r.run(barRefreshInterval, r.renderBar)
+	case ModeLog:
+		logger := zerolog.Ctx(ctx)
+		r.wg.Add(1)
+		go r.run(logInterval, func(s sample) { r.log(logger, s) })
+	case ModeAuto, ModeNone:
+	}
+
+	return r
+}
+
+// Stop stops reporting. When rendering a progress bar, the final state of the bar is kept on screen.
+func (r *Reporter) Stop() {
+	r.once.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+
+		if r.mode == ModeBar {
+			r.renderBar(r.sample())
+			fmt.Fprintln(r.out)
+		}
+	})
+}
+
+func (r *Reporter) run(interval time.Duration, report func(sample)) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			report(r.sample())
+		}
+	}
+}
+
+func (r *Reporter) sample() sample {
+	rows, bytes := r.source()
+	return sample{
+		rows:       rows,
+		bytes:      bytes,
+		totalBytes: r.totalBytes,
+		elapsed:    time.Since(r.startTime),
+	}
+}
+
+func (r *Reporter) renderBar(s sample) {
+	fmt.Fprintf(r.out, "\r%s %s", r.title, s.bar())
+}
+
+func (r *Reporter) log(logger *zerolog.Logger, s sample) {
+	event := logger.Info().
+		Uint64("rows", s.rows).
+		Float64("rows_per_sec", s.rate()).
+		Str("elapsed", s.elapsed.Round(time.Second).String())
+
+	if percent, ok := s.percent(); ok {
+		event = event.Float64("percent", percent)
+	}
+
+	if eta, ok := s.eta(); ok {
+		event = event.Str("eta", eta.Round(time.Second).String())
+	}
+
+	event.Msgf("%s: progress", r.title)
+}
+
+// rate returns the average number of rows processed per second.
+func (s sample) rate() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+
+	return float64(s.rows) / s.elapsed.Seconds()
+}
+
+// percent returns the percentage of input bytes read, if the input size is known.
+func (s sample) percent() (float64, bool) {
+	if s.totalBytes <= 0 {
+		return 0, false
+	}
+
+	percent := float64(s.bytes) / float64(s.totalBytes) * 100
+	if percent > 100 {
+		percent = 100
+	}
+
+	return percent, true
+}
+
+// eta estimates the remaining time from the rate at which input bytes are read so far.
+func (s sample) eta() (time.Duration, bool) {
+	if s.totalBytes <= 0 || s.bytes <= 0 {
+		return 0, false
+	}
+
+	remaining := s.totalBytes - s.bytes
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return time.Duration(float64(s.elapsed) * float64(remaining) / float64(s.bytes)), true
+}
+
+// bar renders the sample as a single line progress bar.
+func (s sample) bar() string {
+	var b strings.Builder
+
+	if percent, ok := s.percent(); ok {
+		filled := int(percent / 100 * barWidth)
+		b.WriteString("[")
+		b.WriteString(strings.Repeat("=", filled))
+		if filled < barWidth {
+			b.WriteString(">")
+			b.WriteString(strings.Repeat(" ", barWidth-filled-1))
+		}
+		fmt.Fprintf(&b, "] %5.1f%% ", percent)
+	}
+
+	fmt.Fprintf(&b, "%d rows, %.0f rows/s, %s elapsed", s.rows, s.rate(), s.elapsed.Round(time.Second))
+
+	if eta, ok := s.eta(); ok {
+		fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+	}
+
+	return b.String()
+}
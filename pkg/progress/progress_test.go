@@ -0,0 +1,64 @@
+package progress
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSample(t *testing.T) {
+	t.Parallel()
+
+	s := sample{
+		rows:       1000,
+		bytes:      250,
+		totalBytes: 1000,
+		elapsed:    10 * time.Second,
+	}
+
+	require.InDelta(t, 100, s.rate(), 0.001)
+
+	percent, ok := s.percent()
+	require.True(t, ok)
+	require.InDelta(t, 25, percent, 0.001)
+
+	eta, ok := s.eta()
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, eta)
+
+	require.Equal(t, "[=======>                      ]  25.0% 1000 rows, 100 rows/s, 10s elapsed, ETA 30s", s.bar())
+}
+
+func TestSample_UnknownSize(t *testing.T) {
+	t.Parallel()
+
+	s := sample{
+		rows:    1000,
+		bytes:   250,
+		elapsed: 10 * time.Second,
+	}
+
+	_, ok := s.percent()
+	require.False(t, ok)
+
+	_, ok = s.eta()
+	require.False(t, ok)
+
+	require.Equal(t, "1000 rows, 100 rows/s, 10s elapsed", s.bar())
+}
+
+func TestReporter_None(t *testing.T) {
+	t.Parallel()
+
+	sampled := false
+	r := Start(context.Background(), ModeNone, "test", 0, func() (uint64, int64) {
+		sampled = true
+		return 0, 0
+	})
+	r.Stop()
+	r.Stop()
+
+	require.False(t, sampled)
+}